@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RoomStatus is the admin API view of a room.
+type RoomStatus struct {
+	ID           string       `json:"id"`
+	Clients      int          `json:"clients"`
+	LastActivity time.Time    `json:"last_activity"`
+	BytesRelayed uint64       `json:"bytes_relayed"`
+	Peers        []PeerStatus `json:"peers"`
+}
+
+// PeerStatus is the admin API view of a single connection.
+type PeerStatus struct {
+	ConnID   string `json:"conn_id"`
+	PeerID   string `json:"peer_id"`
+	Role     string `json:"role"`
+	Name     string `json:"name,omitempty"`
+	IP       string `json:"ip"`
+	Detached bool   `json:"detached,omitempty"`
+	Queued   int    `json:"queued"` // messages waiting in the send queues, data and voice
+}
+
+// Rooms returns a snapshot of every room, sorted by ID.
+func (h *Hub) Rooms() []RoomStatus {
+	h.mu.RLock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+	h.mu.RUnlock()
+
+	out := make([]RoomStatus, 0, len(rooms))
+	for _, room := range rooms {
+		out = append(out, room.Status())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Room returns the status of a single room.
+func (h *Hub) Room(roomID string) (RoomStatus, bool) {
+	h.mu.RLock()
+	room, ok := h.rooms[roomID]
+	h.mu.RUnlock()
+	if !ok {
+		return RoomStatus{}, false
+	}
+	return room.Status(), true
+}
+
+func (r *Room) Status() RoomStatus {
+	st := RoomStatus{
+		ID:           r.id,
+		LastActivity: r.LastActivity(),
+		BytesRelayed: r.BytesRelayed(),
+		Peers:        []PeerStatus{},
+	}
+	for _, c := range r.Clients() {
+		c.mu.Lock()
+		detached := c.detached
+		c.mu.Unlock()
+		info := c.info()
+		st.Peers = append(st.Peers, PeerStatus{
+			ConnID:   c.connID,
+			PeerID:   info.PeerID,
+			Role:     info.Role,
+			Name:     info.Name,
+			IP:       c.ip,
+			Detached: detached,
+			Queued:   len(c.send) + len(c.voice),
+		})
+	}
+	st.Clients = len(st.Peers)
+	sort.Slice(st.Peers, func(i, j int) bool { return st.Peers[i].ConnID < st.Peers[j].ConnID })
+	return st
+}
+
+// CloseRoom disconnects every client in roomID and forgets the room. It
+// returns false if the room does not exist.
+func (h *Hub) CloseRoom(roomID string) bool {
+	found := false
+	h.onShard(roomID, func() {
+		found = h.closeRoom(roomID, websocket.ClosePolicyViolation, "room closed by operator")
+	})
+	return found
+}
+
+// closeRoom disconnects every local peer of roomID with the given close code,
+// after anything already queued for it, and forgets the room. It must run on
+// the room's shard.
+func (h *Hub) closeRoom(roomID string, code int, reason string) bool {
+	h.mu.Lock()
+	room, ok := h.rooms[roomID]
+	if ok {
+		delete(h.rooms, roomID)
+		if h.remoteCount(roomID) == 0 {
+			h.forgetRoom(roomID)
+		}
+		for _, c := range room.Clients() {
+			delete(h.resumeTokens, c.resumeToken)
+		}
+	}
+	h.mu.Unlock()
+	if !ok {
+		return false
+	}
+	for _, c := range room.Clients() {
+		c.Dismiss(code, reason)
+		h.publish(&ClusterEvent{Type: clusterLeave, RoomID: roomID, ConnID: c.connID})
+	}
+	log.Printf("room %s closed: %s", roomID, reason)
+	return true
+}
+
+// Disconnect kicks the connection with the given connID. It returns false if
+// no such connection exists.
+func (h *Hub) Disconnect(connID string) bool {
+	h.mu.RLock()
+	var target *Client
+	for _, room := range h.rooms {
+		if c := room.Get(connID); c != nil {
+			target = c
+			break
+		}
+	}
+	h.mu.RUnlock()
+	if target == nil {
+		return false
+	}
+
+	h.onShard(target.roomID, func() {
+		h.evict(target, websocket.ClosePolicyViolation, "disconnected by operator")
+	})
+	log.Printf("conn %s disconnected by operator", connID[:min(8, len(connID))])
+	return true
+}
+
+// evict closes c's connection with the given close code. A detached client
+// has no connection left, so its slot is dropped directly. It must run on the
+// room's shard.
+func (h *Hub) evict(c *Client, code int, reason string) {
+	c.mu.Lock()
+	detached := c.detached
+	c.mu.Unlock()
+	if detached {
+		h.dropClient(c)
+		return
+	}
+	c.Kick(code, reason)
+}
+
+// SetDraining toggles drain mode: new rooms are refused while existing rooms
+// keep working until their peers leave.
+func (h *Hub) SetDraining(on bool) {
+	h.draining.Store(on)
+	log.Printf("drain mode %v", on)
+}
+
+func (h *Hub) Draining() bool {
+	return h.draining.Load()
+}
+
+// NewAdminServer returns the operator API, served on its own listener and
+// protected by a static bearer token.
+func NewAdminServer(addr, token string, hub *Hub) *http.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /admin/rooms", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, hub.Rooms())
+	})
+	mux.HandleFunc("GET /admin/rooms/{id}", func(w http.ResponseWriter, r *http.Request) {
+		st, ok := hub.Room(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "room not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, st)
+	})
+	mux.HandleFunc("DELETE /admin/rooms/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !hub.CloseRoom(r.PathValue("id")) {
+			http.Error(w, "room not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /admin/conns/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !hub.Disconnect(r.PathValue("id")) {
+			http.Error(w, "connection not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /admin/drain", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]bool{"draining": hub.Draining()})
+	})
+	mux.HandleFunc("PUT /admin/drain", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Draining bool `json:"draining"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		hub.SetDraining(req.Draining)
+		writeJSON(w, http.StatusOK, map[string]bool{"draining": hub.Draining()})
+	})
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           requireBearer(token, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+func requireBearer(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(strings.TrimSpace(r.Header.Get("Authorization")))
+		if token == "" || subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="relay-admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
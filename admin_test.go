@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func adminRequest(t *testing.T, srv *http.Server, method, path, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdmin_RequiresToken(t *testing.T) {
+	srv := NewAdminServer(":0", "s3cret", NewHub(testConfig()))
+
+	if rec := adminRequest(t, srv, "GET", "/admin/rooms", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("no token: status = %d, want 401", rec.Code)
+	}
+	if rec := adminRequest(t, srv, "GET", "/admin/rooms", "wrong", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status = %d, want 401", rec.Code)
+	}
+	if rec := adminRequest(t, srv, "GET", "/admin/rooms", "s3cret", ""); rec.Code != http.StatusOK {
+		t.Errorf("valid token: status = %d, want 200", rec.Code)
+	}
+}
+
+func TestAdmin_ListAndCloseRoom(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	admin := NewAdminServer(":0", "tok", tr.hub)
+
+	pub, priv, hostJWT := hostToken(t, "room-1")
+	host := tr.dial(t, url.Values{
+		"room":   {"room-1"},
+		"token":  {hostJWT},
+		"pubkey": {base64.RawURLEncoding.EncodeToString(pub)},
+	})
+	tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	readEnvelope(t, host, "session:join")
+
+	var rooms []RoomStatus
+	rec := adminRequest(t, admin, "GET", "/admin/rooms", "tok", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &rooms); err != nil {
+		t.Fatalf("decode %s: %v", rec.Body, err)
+	}
+	if len(rooms) != 1 || rooms[0].ID != "room-1" || rooms[0].Clients != 2 {
+		t.Fatalf("rooms = %+v", rooms)
+	}
+	if rooms[0].BytesRelayed == 0 {
+		t.Error("bytes_relayed should count the join notification")
+	}
+
+	if rec := adminRequest(t, admin, "DELETE", "/admin/rooms/room-1", "tok", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("close room: status = %d", rec.Code)
+	}
+	_ = host.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := host.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("expected close 1008, got %v", err)
+			}
+			break
+		}
+	}
+	if tr.hub.RoomCount() != 0 {
+		t.Error("room should be gone after close")
+	}
+	if rec := adminRequest(t, admin, "DELETE", "/admin/rooms/room-1", "tok", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("closing a missing room: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestAdmin_DisconnectConn(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	admin := NewAdminServer(":0", "tok", tr.hub)
+
+	pub, priv, hostJWT := hostToken(t, "room-1")
+	host := tr.dial(t, url.Values{
+		"room":   {"room-1"},
+		"token":  {hostJWT},
+		"pubkey": {base64.RawURLEncoding.EncodeToString(pub)},
+	})
+	tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	readEnvelope(t, host, "session:join")
+
+	st, _ := tr.hub.Room("room-1")
+	var guestConn string
+	for _, p := range st.Peers {
+		if p.PeerID == "guest-1" {
+			guestConn = p.ConnID
+		}
+	}
+
+	if rec := adminRequest(t, admin, "DELETE", "/admin/conns/"+guestConn, "tok", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("disconnect: status = %d", rec.Code)
+	}
+	if leave := readEnvelope(t, host, "session:leave"); leave["from"] != "guest-1" {
+		t.Errorf("leave from %v", leave["from"])
+	}
+}
+
+func TestAdmin_DrainRefusesNewRooms(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	admin := NewAdminServer(":0", "tok", tr.hub)
+
+	if rec := adminRequest(t, admin, "PUT", "/admin/drain", "tok", `{"draining":true}`); rec.Code != http.StatusOK {
+		t.Fatalf("drain: status = %d", rec.Code)
+	}
+
+	pub, _, hostJWT := hostToken(t, "room-new")
+	q := url.Values{
+		"room":   {"room-new"},
+		"token":  {hostJWT},
+		"pubkey": {base64.RawURLEncoding.EncodeToString(pub)},
+	}
+	rec := httptest.NewRecorder()
+	tr.srv.handleWS(rec, httptest.NewRequest("GET", "/ws?"+q.Encode(), nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503 while draining", rec.Code)
+	}
+}
@@ -10,20 +10,80 @@ import (
 	"time"
 )
 
-type Auth struct{}
+// Auth validates session JWTs. The zero value checks signatures and exp
+// only; the fields tighten validation to the relay's policy.
+type Auth struct {
+	ClockSkew   time.Duration // tolerance applied to exp, nbf and iat
+	MaxLifetime time.Duration // longest accepted token lifetime; 0 = unlimited
+	Audience    string        // this relay's identity, matched against aud
+	Issuer      string        // required iss; empty accepts any
+}
 
 func NewAuth() *Auth {
 	return &Auth{}
 }
 
+// Token validation errors. ValidateJWT wraps them with detail for the logs;
+// handleWS maps each to a rejection code without echoing the detail.
+var (
+	ErrTokenMalformed   = errors.New("malformed token")
+	ErrTokenSignature   = errors.New("invalid token signature")
+	ErrTokenExpired     = errors.New("token expired")
+	ErrTokenNotYetValid = errors.New("token not yet valid")
+	ErrTokenLifetime    = errors.New("token lifetime exceeds relay maximum")
+	ErrTokenAudience    = errors.New("token not intended for this relay")
+	ErrTokenIssuer      = errors.New("token issuer not accepted")
+	ErrTokenClaims      = errors.New("invalid token claims")
+)
+
+// audience is the aud claim: a single string or a list (RFC 7519 4.1.3).
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) contains(id string) bool {
+	for _, v := range a {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
 // Claims represents JWT payload for Bind sessions.
 type Claims struct {
-	RoomID    string `json:"room_id"`
-	PeerID    string `json:"peer_id"`
-	Role      string `json:"role"` // "host" or "guest"
-	Name      string `json:"name"`
-	CreatedAt int64  `json:"iat"`
-	ExpiresAt int64  `json:"exp"`
+	RoomID    string   `json:"room_id"`
+	PeerID    string   `json:"peer_id"`
+	Role      string   `json:"role"` // "host" or "guest"
+	Name      string   `json:"name"`
+	CreatedAt int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	Audience  audience `json:"aud,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	JTI       string   `json:"jti,omitempty"` // single-use token ID (guest invites)
+
+	// Optional capabilities. Absent claims allow everything.
+	CanSend  *bool `json:"can_send,omitempty"`  // false: data messages are dropped
+	CanVoice *bool `json:"can_voice,omitempty"` // false: voice packets are dropped
+	RecvOnly bool  `json:"recv_only,omitempty"` // listen only; implies both of the above
+	MaxBps   int64 `json:"max_bps,omitempty"`   // bytes/s budget across voice and data
+	MaxPeers int   `json:"max_peers,omitempty"` // host only: room size, capped by the relay's limit
+	Lobby    bool  `json:"lobby,omitempty"`     // host only: guests wait for the host's approval
+
+	SlowConsumer string `json:"slow_consumer,omitempty"` // host only: the room's slow-consumer policy
 }
 
 // jwtHeader is the fixed header for Ed25519-signed JWTs.
@@ -33,59 +93,105 @@ var jwtHeaderB64 = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","
 func (a *Auth) ValidateJWT(tokenStr string, pubKey []byte) (*Claims, error) {
 	parts := strings.Split(tokenStr, ".")
 	if len(parts) != 3 {
-		return nil, errors.New("malformed JWT")
+		return nil, fmt.Errorf("%w: want 3 parts, got %d", ErrTokenMalformed, len(parts))
 	}
 
 	// Verify header
 	if parts[0] != jwtHeaderB64 {
-		return nil, errors.New("unsupported JWT algorithm")
+		return nil, fmt.Errorf("%w: unsupported algorithm", ErrTokenMalformed)
 	}
 
 	// Verify signature
 	signingInput := parts[0] + "." + parts[1]
 	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
 	if err != nil {
-		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+		return nil, fmt.Errorf("%w: signature encoding: %v", ErrTokenMalformed, err)
 	}
 
 	if len(pubKey) != ed25519.PublicKeySize {
-		return nil, errors.New("invalid public key size")
+		return nil, fmt.Errorf("%w: public key size %d", ErrTokenSignature, len(pubKey))
 	}
 
 	if !ed25519.Verify(ed25519.PublicKey(pubKey), []byte(signingInput), sig) {
-		return nil, errors.New("invalid signature")
+		return nil, ErrTokenSignature
 	}
 
 	// Decode claims
 	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		return nil, fmt.Errorf("invalid claims encoding: %w", err)
+		return nil, fmt.Errorf("%w: claims encoding: %v", ErrTokenMalformed, err)
 	}
 
 	var claims Claims
 	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
-		return nil, fmt.Errorf("invalid claims JSON: %w", err)
+		return nil, fmt.Errorf("%w: claims JSON: %v", ErrTokenMalformed, err)
 	}
 
-	// Check expiry
-	if claims.ExpiresAt > 0 && time.Now().Unix() > claims.ExpiresAt {
-		return nil, errors.New("token expired")
+	if err := a.validateTimes(&claims, time.Now()); err != nil {
+		return nil, err
+	}
+
+	// A token that names audiences must name this relay (RFC 7519 4.1.3).
+	if len(claims.Audience) > 0 && (a.Audience == "" || !claims.Audience.contains(a.Audience)) {
+		return nil, fmt.Errorf("%w: aud %v", ErrTokenAudience, []string(claims.Audience))
+	}
+	if a.Issuer != "" && claims.Issuer != a.Issuer {
+		return nil, fmt.Errorf("%w: iss %q", ErrTokenIssuer, claims.Issuer)
 	}
 
 	// Validate required fields
 	if claims.RoomID == "" {
-		return nil, errors.New("missing room_id")
+		return nil, fmt.Errorf("%w: missing room_id", ErrTokenClaims)
 	}
 	if claims.PeerID == "" {
-		return nil, errors.New("missing peer_id")
+		return nil, fmt.Errorf("%w: missing peer_id", ErrTokenClaims)
 	}
 	if claims.Role != "host" && claims.Role != "guest" {
-		return nil, errors.New("invalid role")
+		return nil, fmt.Errorf("%w: invalid role", ErrTokenClaims)
+	}
+	if claims.MaxBps < 0 || claims.MaxPeers < 0 {
+		return nil, fmt.Errorf("%w: negative limit", ErrTokenClaims)
+	}
+	if claims.SlowConsumer != "" && !validSlowConsumerPolicy(claims.SlowConsumer) {
+		return nil, fmt.Errorf("%w: invalid slow_consumer", ErrTokenClaims)
 	}
 
 	return &claims, nil
 }
 
+// validateTimes checks exp, nbf and iat against now, allowing ClockSkew in
+// either direction, and enforces MaxLifetime.
+func (a *Auth) validateTimes(claims *Claims, now time.Time) error {
+	skew := int64(a.ClockSkew / time.Second)
+	unix := now.Unix()
+
+	if claims.ExpiresAt > 0 && unix > claims.ExpiresAt+skew {
+		return ErrTokenExpired
+	}
+	if claims.NotBefore > 0 && unix < claims.NotBefore-skew {
+		return fmt.Errorf("%w: nbf is %ds ahead", ErrTokenNotYetValid, claims.NotBefore-unix)
+	}
+	if claims.CreatedAt > unix+skew {
+		return fmt.Errorf("%w: iat is %ds ahead", ErrTokenNotYetValid, claims.CreatedAt-unix)
+	}
+
+	if a.MaxLifetime > 0 {
+		if claims.ExpiresAt == 0 {
+			return fmt.Errorf("%w: no exp", ErrTokenLifetime)
+		}
+		// Measure from iat when present; otherwise from now, so a token
+		// without iat cannot claim an arbitrarily distant expiry.
+		start := unix
+		if claims.CreatedAt > 0 {
+			start = claims.CreatedAt
+		}
+		if lifetime := claims.ExpiresAt - start; lifetime > int64(a.MaxLifetime/time.Second)+skew {
+			return fmt.Errorf("%w: %ds", ErrTokenLifetime, lifetime)
+		}
+	}
+	return nil
+}
+
 // SignJWT creates a JWT signed with Ed25519 (used by clients, not relay).
 // Included here for testing convenience.
 func SignJWT(claims *Claims, privateKey ed25519.PrivateKey) string {
@@ -95,3 +201,18 @@ func SignJWT(claims *Claims, privateKey ed25519.PrivateKey) string {
 	sig := ed25519.Sign(privateKey, []byte(signingInput))
 	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
 }
+
+// HostKeyRotationMessage returns the bytes a room's current host key signs to
+// hand the room over to newKey.
+func HostKeyRotationMessage(roomID string, newKey []byte) []byte {
+	msg := []byte("karmagate-relay/rotate-host-key\x00" + roomID + "\x00")
+	return append(msg, newKey...)
+}
+
+// SignHostKeyRotation signs a host key rotation with the current host key and
+// returns it base64url-encoded, as expected in the "rotate" query parameter.
+// Included here for testing convenience.
+func SignHostKeyRotation(oldKey ed25519.PrivateKey, roomID string, newKey []byte) string {
+	sig := ed25519.Sign(oldKey, HostKeyRotationMessage(roomID, newKey))
+	return base64.RawURLEncoding.EncodeToString(sig)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"errors"
 	"testing"
 	"time"
 )
@@ -149,3 +150,94 @@ func TestValidateJWT_HostSignsForGuest(t *testing.T) {
 		t.Errorf("peer_id = %q, want guest-1", got.PeerID)
 	}
 }
+
+func TestValidateJWT_ClaimPolicy(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Now()
+	auth := &Auth{
+		ClockSkew:   30 * time.Second,
+		MaxLifetime: time.Hour,
+		Audience:    "relay-eu",
+		Issuer:      "karmagate",
+	}
+
+	base := func() *Claims {
+		return &Claims{
+			RoomID:    "room",
+			PeerID:    "peer",
+			Role:      "guest",
+			CreatedAt: now.Unix(),
+			ExpiresAt: now.Add(30 * time.Minute).Unix(),
+			Issuer:    "karmagate",
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Claims)
+		want   error
+	}{
+		{"valid", func(c *Claims) {}, nil},
+		{"expired within skew", func(c *Claims) { c.ExpiresAt = now.Add(-10 * time.Second).Unix() }, nil},
+		{"expired", func(c *Claims) { c.ExpiresAt = now.Add(-time.Minute).Unix() }, ErrTokenExpired},
+		{"nbf in future", func(c *Claims) { c.NotBefore = now.Add(5 * time.Minute).Unix() }, ErrTokenNotYetValid},
+		{"nbf within skew", func(c *Claims) { c.NotBefore = now.Add(10 * time.Second).Unix() }, nil},
+		{"iat in future", func(c *Claims) {
+			c.CreatedAt = now.Add(10 * time.Minute).Unix()
+			c.ExpiresAt = now.Add(20 * time.Minute).Unix()
+		}, ErrTokenNotYetValid},
+		{"no exp", func(c *Claims) { c.ExpiresAt = 0 }, ErrTokenLifetime},
+		{"lifetime too long", func(c *Claims) { c.ExpiresAt = now.Add(2 * time.Hour).Unix() }, ErrTokenLifetime},
+		{"lifetime without iat", func(c *Claims) {
+			c.CreatedAt = 0
+			c.ExpiresAt = now.Add(2 * time.Hour).Unix()
+		}, ErrTokenLifetime},
+		{"audience match", func(c *Claims) { c.Audience = audience{"relay-us", "relay-eu"} }, nil},
+		{"audience mismatch", func(c *Claims) { c.Audience = audience{"relay-us"} }, ErrTokenAudience},
+		{"issuer mismatch", func(c *Claims) { c.Issuer = "someone-else" }, ErrTokenIssuer},
+		{"missing room", func(c *Claims) { c.RoomID = "" }, ErrTokenClaims},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := base()
+			tt.modify(claims)
+			_, err := auth.ValidateJWT(SignJWT(claims, priv), pub)
+			if tt.want == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateJWT_AudienceWithoutRelayIdentity(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	token := SignJWT(&Claims{
+		RoomID:    "room",
+		PeerID:    "peer",
+		Role:      "guest",
+		CreatedAt: time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Audience:  audience{"relay-eu"},
+	}, priv)
+
+	// A relay with no configured identity cannot be the intended audience.
+	if _, err := NewAuth().ValidateJWT(token, pub); !errors.Is(err, ErrTokenAudience) {
+		t.Errorf("error = %v, want ErrTokenAudience", err)
+	}
+}
+
+func TestValidateJWT_TypedSignatureErrors(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	token := SignJWT(&Claims{RoomID: "room", PeerID: "peer", Role: "guest"}, priv)
+
+	if _, err := NewAuth().ValidateJWT(token, otherPub); !errors.Is(err, ErrTokenSignature) {
+		t.Errorf("wrong key error = %v, want ErrTokenSignature", err)
+	}
+	if _, err := NewAuth().ValidateJWT("a.b", otherPub); !errors.Is(err, ErrTokenMalformed) {
+		t.Errorf("malformed error = %v, want ErrTokenMalformed", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// authMessageLimit caps the first frame of a connection that authenticates
+// after the upgrade; it only has to fit a joinRequest.
+const authMessageLimit = 16 * 1024
+
+// authMethodMessage labels connections that authenticated with a relay:auth
+// frame in relay_auth_method_total.
+const authMethodMessage = "message"
+
+// authMessage is the first frame of a post-upgrade authentication:
+//
+//	{"type":"relay:auth","payload":{"room":"…","token":"…","pubkey":"…"}}
+type authMessage struct {
+	Type    string      `json:"type"`
+	Payload joinRequest `json:"payload"`
+}
+
+// serveAuthMessage upgrades a handshake that carries no credentials and
+// expects the first frame to be a relay:auth message within AuthTimeout.
+// Failures are reported as a relay:error frame followed by a close frame,
+// which WebSocket client libraries can surface, unlike an HTTP error body.
+func (s *Server) serveAuthMessage(w http.ResponseWriter, r *http.Request, ip string) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("upgrade error: %v", err)
+		return
+	}
+
+	conn.SetReadLimit(authMessageLimit)
+	_ = conn.SetReadDeadline(time.Now().Add(s.cfg.AuthTimeout))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			refuse(conn, &rejection{"auth_timeout", "no relay:auth message received in time", http.StatusRequestTimeout})
+		} else {
+			conn.Close()
+		}
+		return
+	}
+
+	var msg authMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "relay:auth" {
+		refuse(conn, &rejection{"invalid_auth", "first message must be relay:auth", http.StatusBadRequest})
+		return
+	}
+	req := &msg.Payload
+	if req.RoomID == "" || req.Token == "" {
+		refuse(conn, &rejection{"missing_params", "missing room or token", http.StatusBadRequest})
+		return
+	}
+	if target := s.ownerURL(req.RoomID); target != "" {
+		closeWithRedirect(conn, target)
+		return
+	}
+
+	claims, rej := s.admit(req, ip)
+	if rej != nil {
+		refuse(conn, rej)
+		return
+	}
+
+	_ = conn.SetReadDeadline(time.Time{})
+	metrics.AuthMethods.Inc(authMethodMessage)
+	s.join(conn, req, claims, ip)
+}
+
+// refuse reports a rejection on an upgraded connection and closes it, with
+// the rejection code as close reason.
+func refuse(conn *websocket.Conn, rej *rejection) {
+	metrics.HandshakeRejections.Inc(rej.reason)
+
+	deadline := time.Now().Add(writeWait)
+	_ = conn.SetWriteDeadline(deadline)
+	_ = conn.WriteMessage(websocket.BinaryMessage, newRelayError(&RelayError{Code: rej.reason, Message: rej.msg}))
+
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(rej.closeCode(), rej.reason), deadline)
+	conn.Close()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func postUpgradeConfig() *Config {
+	cfg := testConfig()
+	cfg.PostUpgradeAuth = true
+	cfg.AuthTimeout = 500 * time.Millisecond
+	return cfg
+}
+
+// dialBare opens a WebSocket without any credentials.
+func (tr *testRelay) dialBare(t *testing.T) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(tr.url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func sendAuth(t *testing.T, conn *websocket.Conn, req *joinRequest) {
+	t.Helper()
+	data, _ := json.Marshal(&authMessage{Type: "relay:auth", Payload: *req})
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectRefusal reads the relay:error frame and close frame that end a
+// failed post-upgrade authentication.
+func expectRefusal(t *testing.T, conn *websocket.Conn, code string, closeCode int) {
+	t.Helper()
+	e := readEnvelope(t, conn, "relay:error")
+	if got := e["payload"].(map[string]any)["code"]; got != code {
+		t.Errorf("error code = %v, want %s", got, code)
+	}
+	_, _, err := conn.ReadMessage()
+	ce, ok := err.(*websocket.CloseError)
+	if !ok || ce.Code != closeCode || ce.Text != code {
+		t.Errorf("close = %v, want %d %q", err, closeCode, code)
+	}
+}
+
+func TestAuthMessage_Joins(t *testing.T) {
+	tr := newTestRelay(t, postUpgradeConfig())
+	pub, priv, hostJWT := hostToken(t, "room-1")
+
+	host := tr.dialBare(t)
+	sendAuth(t, host, &joinRequest{RoomID: "room-1", Token: hostJWT, Pubkey: base64.RawURLEncoding.EncodeToString(pub)})
+	readEnvelope(t, host, "session:roster")
+
+	before := metrics.AuthMethods.Value(authMethodMessage)
+	guest := tr.dialBare(t)
+	sendAuth(t, guest, &joinRequest{RoomID: "room-1", Token: guestToken(priv, "room-1", "guest-1")})
+	readEnvelope(t, guest, "session:roster")
+	readEnvelope(t, host, "session:join")
+	if got := metrics.AuthMethods.Value(authMethodMessage) - before; got != 1 {
+		t.Errorf("message auth count = %d, want 1", got)
+	}
+}
+
+func TestAuthMessage_Refusals(t *testing.T) {
+	tr := newTestRelay(t, postUpgradeConfig())
+	_, priv, _ := hostToken(t, "room-1")
+
+	t.Run("timeout", func(t *testing.T) {
+		expectRefusal(t, tr.dialBare(t), "auth_timeout", websocket.ClosePolicyViolation)
+	})
+	t.Run("not an auth message", func(t *testing.T) {
+		conn := tr.dialBare(t)
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat"}`))
+		expectRefusal(t, conn, "invalid_auth", websocket.ClosePolicyViolation)
+	})
+	t.Run("unknown room", func(t *testing.T) {
+		conn := tr.dialBare(t)
+		sendAuth(t, conn, &joinRequest{RoomID: "room-1", Token: guestToken(priv, "room-1", "guest-1")})
+		expectRefusal(t, conn, "room_not_found", websocket.ClosePolicyViolation)
+	})
+}
+
+func TestAuthMessage_DisabledByDefault(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	if status := tr.dialStatus(t, nil); status != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", status)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"time"
+)
+
+// capabilities are the restrictions a token places on what its holder may
+// send. The zero value, for a token without capability claims, allows
+// everything the peer's role allows.
+type capabilities struct {
+	noSend  bool // data messages are dropped (can_send=false or recv_only)
+	noVoice bool // voice packets are dropped (can_voice=false or recv_only)
+}
+
+func capabilitiesFrom(claims *Claims) capabilities {
+	if claims.RecvOnly {
+		return capabilities{noSend: true, noVoice: true}
+	}
+	return capabilities{
+		noSend:  claims.CanSend != nil && !*claims.CanSend,
+		noVoice: claims.CanVoice != nil && !*claims.CanVoice,
+	}
+}
+
+// denied returns the capability claim that forbids message, or "" if the
+// client may send it. Control messages are checked by the hub instead.
+func (c capabilities) denied(message []byte) string {
+	if isVoicePacket(message) {
+		if c.noVoice {
+			return "can_voice"
+		}
+		return ""
+	}
+	if c.noSend {
+		return "can_send"
+	}
+	return ""
+}
+
+// capabilityErrors are the relay:warning payloads sent when a client trips a
+// capability, keyed by the claim.
+var capabilityErrors = map[string]*RelayError{
+	"can_send":  {Code: "send_not_permitted", Message: "token does not allow sending messages; they are being dropped"},
+	"can_voice": {Code: "voice_not_permitted", Message: "token does not allow sending voice; it is being dropped"},
+	"max_bps":   {Code: "bandwidth_exceeded", Message: "token bandwidth limit exceeded; messages are being dropped"},
+}
+
+// denyCapability counts a message dropped for exceeding the client's token
+// and warns the client, at most once per warnInterval.
+func (c *Client) denyCapability(claim string) {
+	metrics.CapabilityViolations.Inc(claim)
+	if c.limiter != nil && c.limiter.shouldWarn() {
+		c.trySend(newEnvelope("relay:warning", relayPeerID, capabilityErrors[claim]))
+	}
+}
+
+// applyClaims sets the per-token state of a newly admitted client.
+func (c *Client) applyClaims(claims *Claims) {
+	c.jti = claims.JTI
+	c.caps = capabilitiesFrom(claims)
+	if claims.MaxBps > 0 && c.limiter != nil {
+		c.limiter.capBandwidth(claims.MaxBps)
+	}
+}
+
+// capBandwidth adds a bytes/s budget shared by voice and data, on top of the
+// relay's per-class budgets.
+func (l *clientLimiter) capBandwidth(bps int64) {
+	l.total = newByteBucket(float64(bps))
+}
+
+// allowBandwidth reports whether message fits the token's max_bps budget,
+// consuming tokens if it does.
+func (l *clientLimiter) allowBandwidth(message []byte) bool {
+	return l == nil || l.total == nil || l.total.allowN(time.Now(), len(message))
+}
+
+// SetRoomLimit applies a host token's max_peers to roomID. The relay's own
+// MaxClientsPerRoom still caps it.
+func (h *Hub) SetRoomLimit(roomID string, maxPeers int) {
+	h.mu.Lock()
+	old, ok := h.roomLimits[roomID]
+	h.roomLimits[roomID] = maxPeers
+	h.mu.Unlock()
+
+	if !ok || old != maxPeers {
+		h.publish(&ClusterEvent{Type: clusterRoomLimit, RoomID: roomID, MaxPeers: maxPeers})
+	}
+}
+
+// RoomLimit returns the number of connections roomID admits.
+func (h *Hub) RoomLimit(roomID string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if n, ok := h.roomLimits[roomID]; ok {
+		return min(n, h.cfg.MaxClientsPerRoom)
+	}
+	return h.cfg.MaxClientsPerRoom
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func capabilityToken(priv ed25519.PrivateKey, roomID, peerID string, set func(*Claims)) string {
+	claims := &Claims{
+		RoomID:    roomID,
+		PeerID:    peerID,
+		Role:      "guest",
+		CreatedAt: time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}
+	set(claims)
+	return SignJWT(claims, priv)
+}
+
+// expectSilence fails if conn receives anything other than presence events
+// within a short window.
+func expectSilence(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, msg, err := conn.ReadMessage(); err == nil {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestCapabilities_RecvOnlyObserver(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxVoiceSize = 4096
+	tr := newTestRelay(t, cfg)
+	host, priv := joinAsHost(t, tr, "room-1")
+
+	observer := tr.dial(t, url.Values{"room": {"room-1"}, "token": {
+		capabilityToken(priv, "room-1", "observer-1", func(c *Claims) { c.RecvOnly = true }),
+	}})
+	readEnvelope(t, observer, "session:roster")
+	readEnvelope(t, host, "session:join")
+
+	// The observer still hears the room.
+	_ = host.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"chat","from":"host-1"}`))
+	readEnvelope(t, observer, "chat")
+
+	before := metrics.CapabilityViolations.Value("can_send")
+	_ = observer.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"chat","from":"observer-1"}`))
+	if e := readEnvelope(t, observer, "relay:warning"); e["payload"].(map[string]any)["code"] != "send_not_permitted" {
+		t.Errorf("warning = %v", e["payload"])
+	}
+	_ = observer.WriteMessage(websocket.BinaryMessage, []byte{voiceMagic0, voiceMagic1, 1, 2, 3})
+	expectSilence(t, host)
+
+	if got := metrics.CapabilityViolations.Value("can_send") - before; got != 1 {
+		t.Errorf("can_send violations = %d, want 1", got)
+	}
+}
+
+func TestCapabilities_CanVoiceFalse(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxVoiceSize = 4096
+	tr := newTestRelay(t, cfg)
+	host, priv := joinAsHost(t, tr, "room-1")
+
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {
+		capabilityToken(priv, "room-1", "guest-1", func(c *Claims) { c.CanVoice = new(bool) }),
+	}})
+	readEnvelope(t, guest, "session:roster")
+	readEnvelope(t, host, "session:join")
+
+	before := metrics.CapabilityViolations.Value("can_voice")
+	_ = guest.WriteMessage(websocket.BinaryMessage, []byte{voiceMagic0, voiceMagic1, 1, 2, 3})
+	readEnvelope(t, guest, "relay:warning")
+
+	// Data still goes through.
+	_ = guest.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"chat","from":"guest-1"}`))
+	_ = host.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := host.ReadMessage()
+	if err != nil || isVoicePacket(msg) {
+		t.Fatalf("host got %q, %v; want the chat message only", msg, err)
+	}
+
+	if got := metrics.CapabilityViolations.Value("can_voice") - before; got != 1 {
+		t.Errorf("can_voice violations = %d, want 1", got)
+	}
+}
+
+func TestCapabilities_MaxBps(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	host, priv := joinAsHost(t, tr, "room-1")
+
+	// The burst is one second's worth, however large a message may be: the
+	// first second of traffic fits and the next does not.
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {
+		capabilityToken(priv, "room-1", "guest-1", func(c *Claims) { c.MaxBps = 1024 }),
+	}})
+	readEnvelope(t, guest, "session:roster")
+	readEnvelope(t, host, "session:join")
+
+	before := metrics.CapabilityViolations.Value("max_bps")
+	second := make([]byte, 1024)
+	_ = guest.WriteMessage(websocket.BinaryMessage, second)
+	_ = guest.WriteMessage(websocket.BinaryMessage, second)
+	if e := readEnvelope(t, guest, "relay:warning"); e["payload"].(map[string]any)["code"] != "bandwidth_exceeded" {
+		t.Errorf("warning = %v", e["payload"])
+	}
+	if got := metrics.CapabilityViolations.Value("max_bps") - before; got != 1 {
+		t.Errorf("max_bps violations = %d, want 1", got)
+	}
+}
+
+func TestCapabilities_HostMaxPeers(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	pub, priv, _ := hostToken(t, "room-1")
+	hostJWT := capabilityToken(priv, "room-1", "host-1", func(c *Claims) {
+		c.Role = "host"
+		c.MaxPeers = 2
+	})
+	tr.dial(t, url.Values{"room": {"room-1"}, "token": {hostJWT}, "pubkey": {base64.RawURLEncoding.EncodeToString(pub)}})
+
+	tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	if status := tr.dialStatus(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-2")}}); status != 503 {
+		t.Errorf("third peer status = %d, want 503", status)
+	}
+
+	// max_peers cannot raise the relay's own limit.
+	if got := tr.hub.RoomLimit("room-1"); got != 2 {
+		t.Errorf("RoomLimit = %d, want 2", got)
+	}
+	tr.hub.SetRoomLimit("room-1", 1000)
+	if got := tr.hub.RoomLimit("room-1"); got != testConfig().MaxClientsPerRoom {
+		t.Errorf("RoomLimit = %d, want relay maximum", got)
+	}
+}
+
+func TestClientLimiter_MaxBpsLargeMessage(t *testing.T) {
+	l := newClientLimiter(testConfig())
+	l.capBandwidth(100)
+
+	// A message past the burst passes on a full bucket, then the excess is
+	// owed before anything else does.
+	if !l.allowBandwidth(make([]byte, 300)) {
+		t.Fatal("a large message should pass a full bucket")
+	}
+	if l.allowBandwidth([]byte("x")) {
+		t.Error("budget should be in debt after a large message")
+	}
+}
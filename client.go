@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,13 +22,52 @@ const (
 	pingPeriod     = (pongWait * 9) / 10
 	sendBufferSize = 512
 
+	// voiceBufferSize bounds the voice queue in frames; at 20ms a frame it
+	// holds about a second of audio, and anything older is worthless anyway.
+	voiceBufferSize = 64
+
+	// dataBatchBytes bounds how much queued data WritePump batches into one
+	// frame, so a queued voice frame never waits behind more than that.
+	dataBatchBytes = 64 << 10
+
 	// voiceMagic0/1 are the magic bytes that identify voice packets (0x4B56 = "KV").
 	// Voice packets must be sent as individual WebSocket frames — never batched
 	// with newline separators — because encrypted binary data may contain 0x0A bytes.
 	voiceMagic0 = 0x4B
 	voiceMagic1 = 0x56
+
+	// oversizeDiscardFactor bounds how far past the limit a message may run
+	// before even the "drop" policy gives up and closes with 1009: discarding
+	// a message costs the relay as much bandwidth as relaying it.
+	oversizeDiscardFactor = 4
 )
 
+// newline separates the data messages batched into one frame in newline
+// framing.
+var newline = []byte{'\n'}
+
+// errMessageTooLarge is returned by readMessage when a message exceeded its
+// size limit and was discarded.
+type errMessageTooLarge struct {
+	kind  string
+	size  int64
+	limit int64
+}
+
+func (e *errMessageTooLarge) Error() string {
+	return fmt.Sprintf("%s message of %d bytes exceeds limit of %d", e.kind, e.size, e.limit)
+}
+
+// connReadLimit returns the limit handed to gorilla's SetReadLimit. Messages
+// beyond it are rejected by gorilla itself with close code 1009.
+func connReadLimit(cfg *Config) int64 {
+	limit := max(cfg.MaxMessageSize, cfg.MaxVoiceSize)
+	if cfg.OversizeAction == "drop" {
+		limit *= oversizeDiscardFactor
+	}
+	return limit
+}
+
 func newConnID() string {
 	b := make([]byte, 16)
 	rand.Read(b)
@@ -42,39 +86,135 @@ func extractFromField(data []byte) string {
 	return ""
 }
 
+// toFieldKey is searched for before decoding a message's routing header, so
+// plain broadcasts (the vast majority) are never JSON-decoded.
+var toFieldKey = []byte(`"to"`)
+
+// peerList is the "to" routing field: either a single peer ID or a list.
+type peerList []string
+
+func (p *peerList) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		if one != "" {
+			*p = peerList{one}
+		}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*p = many
+	return nil
+}
+
+// extractToField extracts the optional "to" routing field from a JSON
+// envelope. A nil result means the message is a room-wide broadcast.
+func extractToField(data []byte) []string {
+	if !bytes.Contains(data, toFieldKey) {
+		return nil
+	}
+	var env struct {
+		To peerList `json:"to"`
+	}
+	if json.Unmarshal(data, &env) == nil {
+		return env.To
+	}
+	return nil
+}
+
 // isVoicePacket returns true if data starts with the voice magic bytes.
 func isVoicePacket(data []byte) bool {
 	return len(data) >= 2 && data[0] == voiceMagic0 && data[1] == voiceMagic1
 }
 
 type Client struct {
-	hub    *Hub
-	conn   *websocket.Conn
-	roomID string
-	peerID string // from JWT (used in leave notifications)
-	connID string // unique per connection (used for room tracking)
-	role   string
-	ip     string
-	send   chan []byte
+	hub         *Hub
+	conn        *websocket.Conn
+	roomID      string
+	peerID      string // from JWT (used in leave notifications)
+	tokenPeerID string // peer_id the JWT was issued for; never relearned
+	connID      string // unique per connection (used for room tracking)
+	role        string
+	jti         string // token ID of a single-use invite, if any
+	caps        capabilities
+	muted       atomic.Bool  // voice dropped by the host's relay:mute
+	waiting     atomic.Bool  // in the lobby; messages are dropped
+	overflow    atomic.Int64 // messages dropped since the last relay:overflow
+	name        string       // display name from JWT
+	ip          string
+	send        chan []byte    // data and relay envelopes, in order
+	voice       chan *frameBuf // voice frames; written ahead of send
+	records     bool           // batches are length-prefixed records; see framing.go
+
+	// dataBytes and voiceBytes are the bytes waiting in send and voice,
+	// bounded by dataBudget and voiceBudget (0 means unbounded).
+	dataBytes   atomic.Int64
+	voiceBytes  atomic.Int64
+	dataBudget  int64
+	voiceBudget int64
 
+	limiter *clientLimiter
+
+	// done is closed when ReadPump exits so WritePump stops with it.
+	done      chan struct{}
+	stopOnce  sync.Once
+	startOnce sync.Once
+
+	// recordHeader is WritePump's scratch space for record lengths.
+	recordHeader [recordHeaderSize]byte
+
+	// farewell is the close frame payload WritePump sends once send is
+	// closed; see closeWith.
+	farewell []byte
+
+	// resumable is set by ReadPump when the connection dropped abruptly
+	// (rather than being closed by either side) and may be resumed.
+	resumable   bool
+	resumeToken string
+	kicked      bool // closed by the relay; never resumable
+
+	mu        sync.Mutex
+	closed    bool
+	detached  bool // connection lost; send acts as a replay ring buffer
+	replayGap bool // replay buffer overflowed while detached
 	closeOnce sync.Once
 }
 
-func NewClient(hub *Hub, conn *websocket.Conn, roomID, peerID, role, ip string) *Client {
+func NewClient(hub *Hub, conn *websocket.Conn, roomID, peerID, role, name, ip string) *Client {
 	return &Client{
-		hub:    hub,
-		conn:   conn,
-		roomID: roomID,
-		peerID: peerID,
-		connID: newConnID(),
-		role:   role,
-		ip:     ip,
-		send:   make(chan []byte, sendBufferSize),
+		hub:         hub,
+		conn:        conn,
+		roomID:      roomID,
+		peerID:      peerID,
+		tokenPeerID: peerID,
+		connID:      newConnID(),
+		role:        role,
+		name:        name,
+		ip:          ip,
+		send:        make(chan []byte, sendBufferSize),
+		voice:       make(chan *frameBuf, voiceBufferSize),
+		dataBudget:  hub.cfg.DataQueueBytes,
+		voiceBudget: hub.cfg.VoiceQueueBytes,
+
+		limiter: newClientLimiter(hub.cfg),
+		done:    make(chan struct{}),
 	}
 }
 
+// start runs the client's pumps. A lobby guest's pumps are already running
+// when it is admitted to the room.
+func (c *Client) start() {
+	c.startOnce.Do(func() {
+		go c.ReadPump()
+		go c.WritePump()
+	})
+}
+
 func (c *Client) ReadPump() {
 	defer func() {
+		c.stop()
 		c.hub.Unregister(c)
 		c.conn.Close()
 	}()
@@ -84,35 +224,176 @@ func (c *Client) ReadPump() {
 		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	})
 
+	// voice is a pooled voice frame not yet handed to the hub. Data is kept
+	// beyond the broadcast (replay buffers, the backplane), so it is copied
+	// out of its buffer instead.
+	var voice *frameBuf
+	defer func() {
+		if voice != nil {
+			voice.release()
+		}
+	}()
+
 	peerIDLearned := false
 	for {
-		_, message, err := c.conn.ReadMessage()
+		if voice != nil {
+			voice.release()
+			voice = nil
+		}
+		frame, err := c.readMessage()
+		var tooLarge *errMessageTooLarge
+		if errors.As(err, &tooLarge) {
+			metrics.OversizeMessages.Inc(tooLarge.kind, c.hub.cfg.OversizeAction)
+			if c.hub.cfg.OversizeAction == "drop" {
+				c.trySend(newRelayError(&RelayError{
+					Code:    "message_too_large",
+					Message: tooLarge.Error(),
+					Size:    tooLarge.size,
+					Limit:   tooLarge.limit,
+				}))
+				continue
+			}
+			log.Printf("closing peer=%s room=%s: %v", c.peerID, c.roomID, err)
+			_ = c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "message too large"),
+				time.Now().Add(writeWait))
+			return
+		}
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 				log.Printf("read error peer=%s room=%s: %v", c.peerID, c.roomID, err)
 			}
+			c.mu.Lock()
+			c.resumable = isAbruptDisconnect(err) && !c.kicked
+			c.mu.Unlock()
 			return
 		}
+		var message []byte
+		if isVoicePacket(frame.b) {
+			message, voice = frame.b, frame
+		} else {
+			message = bytes.Clone(frame.b)
+			frame.release()
+		}
+
+		if c.waiting.Load() {
+			continue
+		}
+
+		if !c.limiter.allow(message) {
+			action := c.hub.cfg.ClientRateAction
+			metrics.RateLimited.Inc(packetKind(message), action)
+			switch action {
+			case "disconnect":
+				log.Printf("closing peer=%s room=%s: rate limit exceeded", c.peerID, c.roomID)
+				_ = c.conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"),
+					time.Now().Add(writeWait))
+				return
+			case "warn":
+				if c.limiter.shouldWarn() {
+					c.trySend(newEnvelope("relay:warning", relayPeerID, &RelayError{
+						Code:    "rate_limited",
+						Message: "message rate limit exceeded; messages are being dropped",
+					}))
+				}
+			}
+			continue
+		}
+		if !c.limiter.allowBandwidth(message) {
+			c.denyCapability("max_bps")
+			continue
+		}
 
 		// Learn the client's actual peerID from the first non-voice message.
 		// The client may generate a fresh UUID that differs from the JWT's
 		// peer_id (e.g. when multiple guests reuse one invite link).
-		if !peerIDLearned && !isVoicePacket(message) {
+		if !peerIDLearned && !isVoicePacket(message) && !isTransferChunk(message) {
 			if realID := extractFromField(message); realID != "" && realID != c.peerID {
 				log.Printf("peer %s identified as %s (room %s)", c.peerID, realID, c.roomID)
-				c.peerID = realID
+				c.setPeerID(realID)
 			}
 			peerIDLearned = true
 		}
 
+		var to []string
+		if !isVoicePacket(message) && isControlMessage(message) {
+			c.hub.Control(c, message)
+			continue
+		}
+		if claim := c.caps.denied(message); claim != "" && !isTransferAck(message) {
+			c.denyCapability(claim)
+			continue
+		}
+		if c.muted.Load() && isVoicePacket(message) {
+			continue
+		}
+		if !isVoicePacket(message) && !isTransferChunk(message) {
+			to = extractToField(message)
+		}
+
 		c.hub.Broadcast(&BroadcastMsg{
 			RoomID:   c.roomID,
 			SenderID: c.connID,
+			To:       to,
 			Data:     message,
+			frame:    voice,
 		})
+		voice = nil
 	}
 }
 
+// readMessage reads the next message into a pooled buffer and enforces the
+// voice or data size limit, classifying the message by its first two bytes
+// as soon as they arrive. An oversized message is drained from the
+// connection and reported as *errMessageTooLarge so the caller can decide
+// whether to keep reading. The caller owns the returned buffer.
+func (c *Client) readMessage() (*frameBuf, error) {
+	_, r, err := c.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := c.hub.cfg
+	kind, limit := "data", cfg.MaxMessageSize
+	classified := false
+	f := newFrameBuf()
+	for {
+		if len(f.b) == cap(f.b) {
+			f.b = slices.Grow(f.b, len(f.b))
+		}
+		n, err := r.Read(f.b[len(f.b):cap(f.b)])
+		f.b = f.b[:len(f.b)+n]
+		if !classified && (len(f.b) >= 2 || err != nil) {
+			classified = true
+			if isVoicePacket(f.b) {
+				kind, limit = "voice", cfg.MaxVoiceSize
+			} else if isTransferChunk(f.b) {
+				kind, limit = "chunk", cfg.TransferChunkSize+chunkHeaderMax
+			}
+		}
+		if size := int64(len(f.b)); size > limit {
+			f.release()
+			discarded, err := io.Copy(io.Discard, r)
+			if err != nil {
+				return nil, err
+			}
+			return nil, &errMessageTooLarge{kind: kind, size: size + discarded, limit: limit}
+		}
+		if err == io.EOF {
+			return f, nil
+		}
+		if err != nil {
+			f.release()
+			return nil, err
+		}
+	}
+}
+
+// WritePump writes queued messages to the connection. Voice has strict
+// priority: a queued voice frame is always written before the next data
+// frame, and data is batched only up to dataBatchBytes so voice never waits
+// long behind it.
 func (c *Client) WritePump() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
@@ -122,52 +403,33 @@ func (c *Client) WritePump() {
 
 	for {
 		select {
-		case message, ok := <-c.send:
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		case frame := <-c.voice:
+			if err := c.writeVoice(frame); err != nil {
 				return
 			}
+			continue
+		default:
+		}
 
-			// Voice packets MUST be sent as individual frames — never batched.
-			// Encrypted binary voice data may contain 0x0A (newline) bytes,
-			// which would corrupt the message if batched with '\n' separator.
-			if isVoicePacket(message) {
-				if err := c.conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
-					return
-				}
-				// After sending voice, drain any more voice packets immediately
-				// for minimal latency, but don't batch them.
-				for {
-					select {
-					case next, ok2 := <-c.send:
-						if !ok2 {
-							return
-						}
-						if isVoicePacket(next) {
-							if err := c.conn.WriteMessage(websocket.BinaryMessage, next); err != nil {
-								return
-							}
-						} else {
-							// Non-voice message: send it normally, potentially batching
-							if err := c.writeDataMessage(next); err != nil {
-								return
-							}
-							goto afterDrain
-						}
-					default:
-						goto afterDrain
-					}
-				}
-			afterDrain:
-				continue
+		select {
+		case frame := <-c.voice:
+			if err := c.writeVoice(frame); err != nil {
+				return
 			}
 
-			// Data (non-voice) messages: batch with newline separator for throughput
+		case message, ok := <-c.send:
+			if !ok {
+				_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				_ = c.conn.WriteMessage(websocket.CloseMessage, c.farewell)
+				return
+			}
 			if err := c.writeDataMessage(message); err != nil {
 				return
 			}
 
+		case <-c.done:
+			return
+
 		case <-ticker.C:
 			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -177,44 +439,238 @@ func (c *Client) WritePump() {
 	}
 }
 
-// writeDataMessage writes a data message, batching any queued non-voice messages.
+// writeVoice writes a voice frame and releases it. Voice packets MUST be
+// sent as individual frames — never batched. Encrypted binary voice data may
+// contain 0x0A (newline) bytes, which would corrupt the message if batched
+// with '\n'.
+func (c *Client) writeVoice(frame *frameBuf) error {
+	defer frame.release()
+	c.voiceBytes.Add(-int64(len(frame.b)))
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return frame.write(c.conn, c.records)
+}
+
+// writeDataMessage writes a data message, batching queued data messages
+// behind it until the frame holds dataBatchBytes or a voice frame is
+// waiting. In newline framing transfer chunks are binary, so like voice they
+// always go in frames of their own.
 func (c *Client) writeDataMessage(message []byte) error {
+	c.dataBytes.Add(-int64(len(message)))
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if !c.records && isTransferChunk(message) {
+		return c.conn.WriteMessage(websocket.BinaryMessage, message)
+	}
 	w, err := c.conn.NextWriter(websocket.BinaryMessage)
 	if err != nil {
 		return err
 	}
-	_, _ = w.Write(message)
+	if err := c.writeRecord(w, message); err != nil {
+		return err
+	}
 
-	// Drain queued data messages into the same write (batching for throughput).
-	// Voice packets in the queue are sent separately after closing this writer.
-	var pendingVoice [][]byte
-	n := len(c.send)
-	for i := 0; i < n; i++ {
+	// Only WritePump receives from send, so len(c.send) messages can be
+	// taken without blocking, even once send is closed.
+	batched := len(message)
+	for batched < dataBatchBytes && len(c.send) > 0 && len(c.voice) == 0 {
 		next := <-c.send
-		if isVoicePacket(next) {
-			pendingVoice = append(pendingVoice, next)
-		} else {
-			_, _ = w.Write([]byte{'\n'})
-			_, _ = w.Write(next)
+		c.dataBytes.Add(-int64(len(next)))
+		if !c.records && isTransferChunk(next) {
+			if err := w.Close(); err != nil {
+				return err
+			}
+			return c.conn.WriteMessage(websocket.BinaryMessage, next)
+		}
+		batched += len(next) + 1
+		if !c.records {
+			_, _ = w.Write(newline)
+		}
+		if err := c.writeRecord(w, next); err != nil {
+			return err
 		}
 	}
+	return w.Close()
+}
 
-	if err := w.Close(); err != nil {
-		return err
+// writeChunked writes message to w in dataBatchBytes pieces, extending the
+// write deadline after each one. A large message then only fails if the
+// peer stops reading, not because the whole message took longer than
+// writeWait to go out.
+func writeChunked(conn *websocket.Conn, w io.Writer, message []byte) error {
+	for len(message) > dataBatchBytes {
+		if _, err := w.Write(message[:dataBatchBytes]); err != nil {
+			return err
+		}
+		message = message[dataBatchBytes:]
+		_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
 	}
+	_, err := w.Write(message)
+	return err
+}
 
-	// Flush any voice packets that were queued between data messages
-	for _, vp := range pendingVoice {
-		if err := c.conn.WriteMessage(websocket.BinaryMessage, vp); err != nil {
-			return err
+// PeerID returns the client's current peer ID. ReadPump may replace it with
+// the ID the client announces, so other goroutines must use this accessor.
+func (c *Client) PeerID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerID
+}
+
+// info describes the client for join and roster notifications.
+func (c *Client) info() PeerInfo {
+	return PeerInfo{PeerID: c.PeerID(), Role: c.role, Name: c.name}
+}
+
+func (c *Client) setPeerID(id string) {
+	c.mu.Lock()
+	c.peerID = id
+	c.mu.Unlock()
+}
+
+// trySend queues data for the client without blocking: voice frames on the
+// voice queue, everything else on send. It returns false if the queue is
+// full, in messages or bytes, or the client has already been closed. While
+// the client is detached voice is dropped and send behaves as a ring: the
+// oldest messages are evicted to make room and the resulting gap is reported
+// on resume.
+func (c *Client) trySend(data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	if isVoicePacket(data) {
+		f := frameOf(data)
+		defer f.release()
+		return c.queueVoiceLocked(f)
+	}
+	if enqueue(c.send, &c.dataBytes, c.dataBudget, data) {
+		return true
+	}
+	if !c.detached {
+		return false
+	}
+	for {
+		select {
+		case old := <-c.send:
+			c.dataBytes.Add(-int64(len(old)))
+			c.replayGap = true
+		default:
+			return false
+		}
+		if enqueue(c.send, &c.dataBytes, c.dataBudget, data) {
+			return true
 		}
 	}
+}
 
-	return nil
+// queueVoice queues a voice frame for the client, taking a reference to it
+// if it was queued. Voice is dropped while the client is detached: stale
+// audio is not worth replaying.
+func (c *Client) queueVoice(f *frameBuf) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.closed && c.queueVoiceLocked(f)
+}
+
+func (c *Client) queueVoiceLocked(f *frameBuf) bool {
+	if c.detached || !reserve(&c.voiceBytes, c.voiceBudget, len(f.b)) {
+		return false
+	}
+	f.retain()
+	select {
+	case c.voice <- f:
+		return true
+	default:
+		f.release()
+		c.voiceBytes.Add(-int64(len(f.b)))
+		return false
+	}
+}
+
+// enqueue adds data to queue q, whose queued byte count is n, unless that
+// would take it over budget.
+func enqueue(q chan []byte, n *atomic.Int64, budget int64, data []byte) bool {
+	if !reserve(n, budget, len(data)) {
+		return false
+	}
+	select {
+	case q <- data:
+		return true
+	default:
+		n.Add(-int64(len(data)))
+		return false
+	}
+}
+
+// reserve adds size bytes to the queued count n unless that takes it over
+// budget. An empty queue takes any one message, so a message larger than the
+// budget is delayed, never refused outright.
+func reserve(n *atomic.Int64, budget int64, size int) bool {
+	s := int64(size)
+	if queued := n.Add(s); budget > 0 && queued > budget && queued != s {
+		n.Add(-s)
+		return false
+	}
+	return true
+}
+
+// Kick closes the connection from the relay side with the given close code.
+// A kicked client is removed immediately and cannot resume its session.
+func (c *Client) Kick(code int, reason string) {
+	c.mu.Lock()
+	c.kicked = true
+	c.mu.Unlock()
+
+	_ = c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	c.conn.Close()
+}
+
+// refuse sends c a relay:error, then closes the connection the way a refused
+// relay:auth is closed.
+func (c *Client) refuse(rej *rejection) {
+	c.trySend(newRelayError(&RelayError{Code: rej.reason, Message: rej.msg}))
+	c.Dismiss(rej.closeCode(), rej.reason)
+}
+
+// Dismiss closes the connection with the given close code once the messages
+// already queued for c are written. Unlike Kick, nothing queued is lost.
+func (c *Client) Dismiss(code int, reason string) {
+	c.mu.Lock()
+	c.kicked = true
+	c.mu.Unlock()
+	c.closeWith(websocket.FormatCloseMessage(code, reason))
+}
+
+// stop signals WritePump that the connection is finished.
+func (c *Client) stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// isAbruptDisconnect reports whether a read error means the connection was
+// lost (network failure, abnormal closure) rather than closed by a peer.
+func isAbruptDisconnect(err error) bool {
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		return ce.Code == websocket.CloseAbnormalClosure
+	}
+	return true
 }
 
 func (c *Client) Close() {
+	c.closeWith(nil)
+}
+
+// closeWith closes send; WritePump then flushes the queue and sends a close
+// frame with the given payload.
+func (c *Client) closeWith(farewell []byte) {
 	c.closeOnce.Do(func() {
+		c.farewell = farewell
+		c.mu.Lock()
+		c.closed = true
 		close(c.send)
+		c.mu.Unlock()
 	})
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestConnPair returns the relay side and the peer side of a live
+// WebSocket connection.
+func newTestConnPair(t *testing.T) (relaySide, peerSide *websocket.Conn) {
+	t.Helper()
+
+	connCh := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		connCh <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+
+	relay := <-connCh
+	t.Cleanup(func() { relay.Close() })
+	return relay, peer
+}
+
+func TestClient_ReadMessage_DropOversized(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxMessageSize = 64
+	cfg.MaxVoiceSize = 16
+	cfg.OversizeAction = "drop"
+
+	relay, peer := newTestConnPair(t)
+	relay.SetReadLimit(connReadLimit(cfg))
+	c := NewClient(NewHub(cfg), relay, "room", "peer", "guest", "", "127.0.0.1")
+
+	voice := append([]byte{voiceMagic0, voiceMagic1}, bytes.Repeat([]byte{0x0A}, 30)...)
+	_ = peer.WriteMessage(websocket.BinaryMessage, voice)
+	_ = peer.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"chat"}`))
+
+	_, err := c.readMessage()
+	tooLarge, ok := err.(*errMessageTooLarge)
+	if !ok {
+		t.Fatalf("expected *errMessageTooLarge, got %v", err)
+	}
+	if tooLarge.kind != "voice" || tooLarge.size != 32 || tooLarge.limit != 16 {
+		t.Errorf("got %+v, want voice size=32 limit=16", tooLarge)
+	}
+
+	// The connection stays usable after a dropped message.
+	msg, err := c.readMessage()
+	if err != nil {
+		t.Fatalf("readMessage after drop: %v", err)
+	}
+	if string(msg.b) != `{"type":"chat"}` {
+		t.Errorf("got %q", msg.b)
+	}
+}
+
+func TestClient_ReadPump_OversizedDropSendsError(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxMessageSize = 8
+	cfg.OversizeAction = "drop"
+
+	relay, peer := newTestConnPair(t)
+	c := NewClient(NewHub(cfg), relay, "room", "peer", "guest", "", "127.0.0.1")
+	go c.ReadPump()
+	go c.WritePump()
+
+	_ = peer.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"too-large"}`))
+
+	_ = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := peer.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var env struct {
+		Type    string     `json:"type"`
+		From    string     `json:"from"`
+		Payload RelayError `json:"payload"`
+	}
+	if err := json.Unmarshal(msg, &env); err != nil {
+		t.Fatalf("unmarshal %q: %v", msg, err)
+	}
+	if env.Type != "relay:error" || env.From != relayPeerID || env.Payload.Code != "message_too_large" {
+		t.Errorf("unexpected envelope %s", msg)
+	}
+	if env.Payload.Limit != 8 {
+		t.Errorf("limit = %d, want 8", env.Payload.Limit)
+	}
+}
+
+func TestClient_ReadPump_OversizedClose(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxMessageSize = 1024
+	cfg.MaxVoiceSize = 4
+	cfg.OversizeAction = "close"
+
+	relay, peer := newTestConnPair(t)
+	relay.SetReadLimit(connReadLimit(cfg))
+	c := NewClient(NewHub(cfg), relay, "room", "peer", "guest", "", "127.0.0.1")
+	go c.ReadPump()
+
+	_ = peer.WriteMessage(websocket.BinaryMessage, []byte{voiceMagic0, voiceMagic1, 1, 2, 3, 4})
+
+	_ = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := peer.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("expected close 1009, got %v", err)
+	}
+}
+
+func TestExtractToField(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"absent", `{"type":"chat","from":"a"}`, nil},
+		{"single", `{"type":"chat","from":"a","to":"b"}`, []string{"b"}},
+		{"list", `{"type":"chat","from":"a","to":["b","c"]}`, []string{"b", "c"}},
+		{"empty string", `{"type":"chat","to":""}`, nil},
+		{"only in payload", `{"type":"chat","payload":{"to":"b"}}`, nil},
+		{"not json", `"to" garbage`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := extractToField([]byte(tt.data))
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("extractToField = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// readFrames reads n frames from conn.
+func readFrames(t *testing.T, conn *websocket.Conn, n int) [][]byte {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frames := make([][]byte, n)
+	for i := range frames {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		frames[i] = msg
+	}
+	return frames
+}
+
+func TestClient_WritePump_VoiceFirst(t *testing.T) {
+	relay, peer := newTestConnPair(t)
+	c := NewClient(NewHub(testConfig()), relay, "room", "peer", "guest", "", "127.0.0.1")
+
+	voice1 := []byte{voiceMagic0, voiceMagic1, 1, '\n'}
+	voice2 := []byte{voiceMagic0, voiceMagic1, 2, '\n'}
+	c.trySend([]byte(`{"n":1}`))
+	c.trySend(voice1)
+	c.trySend([]byte(`{"n":2}`))
+	c.trySend(voice2)
+	go c.WritePump()
+	defer c.stop()
+
+	// Queued voice goes out first, one frame each and in order; the data
+	// behind it is batched, also in order.
+	want := [][]byte{voice1, voice2, []byte("{\"n\":1}\n{\"n\":2}")}
+	for i, got := range readFrames(t, peer, len(want)) {
+		if !bytes.Equal(got, want[i]) {
+			t.Errorf("frame %d = %q, want %q", i, got, want[i])
+		}
+	}
+	if n := c.dataBytes.Load() + c.voiceBytes.Load(); n != 0 {
+		t.Errorf("queued bytes after flush = %d, want 0", n)
+	}
+}
+
+func TestClient_WritePump_DataBatchBound(t *testing.T) {
+	relay, peer := newTestConnPair(t)
+	c := NewClient(NewHub(testConfig()), relay, "room", "peer", "guest", "", "127.0.0.1")
+
+	var msgs [][]byte
+	for i := range 3 {
+		msgs = append(msgs, bytes.Repeat([]byte{'a' + byte(i)}, dataBatchBytes/2+1))
+		c.trySend(msgs[i])
+	}
+	go c.WritePump()
+	defer c.stop()
+
+	// The first frame holds as many messages as fit in dataBatchBytes,
+	// the rest follow in later frames.
+	frames := readFrames(t, peer, 2)
+	if want := bytes.Join(msgs[:2], []byte{'\n'}); !bytes.Equal(frames[0], want) {
+		t.Errorf("first frame is %d bytes, want the first two messages (%d bytes)", len(frames[0]), len(want))
+	}
+	if !bytes.Equal(frames[1], msgs[2]) {
+		t.Errorf("second frame is %d bytes, want the third message", len(frames[1]))
+	}
+}
+
+func TestClient_TrySend_ByteBudgets(t *testing.T) {
+	cfg := testConfig()
+	cfg.DataQueueBytes = 100
+	cfg.VoiceQueueBytes = 10
+	c := NewClient(NewHub(cfg), nil, "room", "peer", "guest", "", "127.0.0.1")
+
+	// An empty queue takes any one message, however large.
+	if !c.trySend(bytes.Repeat([]byte{'x'}, 150)) {
+		t.Fatal("oversized message refused by an empty data queue")
+	}
+	if c.trySend([]byte(`{}`)) {
+		t.Error("data queue accepted a message past its budget")
+	}
+
+	voice := []byte{voiceMagic0, voiceMagic1, 1, 2, 3, 4}
+	if !c.trySend(voice) {
+		t.Fatal("voice refused although the voice queue is empty")
+	}
+	if c.trySend(voice) {
+		t.Error("voice queue accepted a frame past its budget")
+	}
+	if got := c.voiceBytes.Load(); got != int64(len(voice)) {
+		t.Errorf("voiceBytes = %d, want %d", got, len(voice))
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies is the set of networks whose forwarding headers (and PROXY
+// protocol headers) the relay believes.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a list of CIDRs or bare IP addresses.
+func parseTrustedProxies(entries []string) (trustedProxies, error) {
+	var nets trustedProxies
+	for _, e := range entries {
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", e)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", e, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (t trustedProxies) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address used to identify a client (rate limiting,
+// logs). Forwarding headers are only honoured when the direct peer is a
+// trusted proxy; X-Forwarded-For is then walked right to left and the first
+// hop that is not itself a trusted proxy wins, so a client cannot spoof its
+// address by prepending entries.
+func clientIP(r *http.Request, trusted trustedProxies) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if !trusted.contains(net.ParseIP(peer)) {
+		return peer
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		var hops []string
+		for _, v := range xff {
+			for _, hop := range strings.Split(v, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		last := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(hops[i])
+			if ip == nil {
+				// Garbage in the chain: the closest trusted hop is the
+				// best address we can vouch for.
+				return last
+			}
+			if !trusted.contains(ip) {
+				return ip.String()
+			}
+			last = ip.String()
+		}
+		return last
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peer
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		xri        string
+		want       string
+	}{
+		{"direct, no headers", "203.0.113.7:5555", nil, "", "203.0.113.7"},
+		{"untrusted peer spoofs XFF", "203.0.113.7:5555", []string{"1.1.1.1"}, "", "203.0.113.7"},
+		{"untrusted peer spoofs X-Real-IP", "203.0.113.7:5555", nil, "1.1.1.1", "203.0.113.7"},
+		{"trusted proxy, single hop", "10.0.0.2:443", []string{"198.51.100.4"}, "", "198.51.100.4"},
+		{"client prepends fake hop", "10.0.0.2:443", []string{"1.1.1.1, 198.51.100.4"}, "", "198.51.100.4"},
+		{"chain of trusted proxies", "10.0.0.2:443", []string{"198.51.100.4, 192.168.1.1", "10.1.2.3"}, "", "198.51.100.4"},
+		{"all hops trusted", "10.0.0.2:443", []string{"10.9.9.9"}, "", "10.9.9.9"},
+		{"garbage hop", "10.0.0.2:443", []string{"not-an-ip, 10.1.1.1"}, "", "10.1.1.1"},
+		{"trusted proxy, X-Real-IP", "192.168.1.1:443", nil, "198.51.100.9", "198.51.100.9"},
+		{"trusted proxy, no headers", "192.168.1.1:443", nil, "", "192.168.1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ws", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.xri != "" {
+				r.Header.Set("X-Real-IP", tt.xri)
+			}
+			if got := clientIP(r, trusted); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies_Invalid(t *testing.T) {
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+	if _, err := parseTrustedProxies([]string{"proxy.local"}); err == nil {
+		t.Error("expected error for hostname")
+	}
+}
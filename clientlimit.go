@@ -0,0 +1,107 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// warnInterval throttles relay:warning envelopes so a flooding client does
+// not get a warning per dropped message.
+const warnInterval = time.Second
+
+// clientLimiter enforces per-connection message and bandwidth budgets, with
+// separate buckets for voice and data so a data flood cannot eat the voice
+// budget and vice versa. Only the client's ReadPump goroutine uses it.
+type clientLimiter struct {
+	data     classLimiter
+	voice    classLimiter
+	total    *byteBucket // the token's max_bps, if any
+	lastWarn time.Time
+}
+
+// classLimiter pairs a messages/s and a bytes/s bucket. A nil bucket means
+// unlimited.
+type classLimiter struct {
+	msgs  *rate.Limiter
+	bytes *byteBucket
+}
+
+func newClientLimiter(cfg *Config) *clientLimiter {
+	return &clientLimiter{
+		data:  newClassLimiter(cfg.ClientDataMsgRate, cfg.ClientDataByteRate),
+		voice: newClassLimiter(cfg.ClientVoiceMsgRate, cfg.ClientVoiceByteRate),
+	}
+}
+
+func newClassLimiter(msgRate, byteRate float64) classLimiter {
+	var l classLimiter
+	if msgRate > 0 {
+		l.msgs = rate.NewLimiter(rate.Limit(msgRate), max(int(msgRate)*2, 1))
+	}
+	if byteRate > 0 {
+		l.bytes = newByteBucket(byteRate)
+	}
+	return l
+}
+
+// byteBucket is a bytes/s budget whose burst is one second's worth. A message
+// larger than the burst passes only on a full bucket and puts the bucket in
+// debt: nothing else passes until the excess has been paid off at the rate.
+type byteBucket struct {
+	lim  *rate.Limiter
+	debt time.Time
+}
+
+func newByteBucket(bps float64) *byteBucket {
+	return &byteBucket{lim: rate.NewLimiter(rate.Limit(bps), max(int(bps), 1))}
+}
+
+// allowN reports whether n bytes fit the budget at now, consuming tokens if
+// they do.
+func (b *byteBucket) allowN(now time.Time, n int) bool {
+	if now.Before(b.debt) {
+		return false
+	}
+	burst := b.lim.Burst()
+	if n <= burst {
+		return b.lim.AllowN(now, n)
+	}
+	if !b.lim.AllowN(now, burst) {
+		return false
+	}
+	b.debt = now.Add(time.Duration(float64(n-burst) / float64(b.lim.Limit()) * float64(time.Second)))
+	return true
+}
+
+// allow reports whether message fits the sender's budget, consuming tokens
+// if it does.
+func (l *clientLimiter) allow(message []byte) bool {
+	if l == nil {
+		return true
+	}
+	cl := &l.data
+	if isVoicePacket(message) {
+		cl = &l.voice
+	}
+
+	now := time.Now()
+	if cl.msgs != nil && !cl.msgs.AllowN(now, 1) {
+		return false
+	}
+	if cl.bytes != nil && !cl.bytes.allowN(now, len(message)) {
+		return false
+	}
+	return true
+}
+
+// shouldWarn reports whether a warning may be sent now, at most once per
+// warnInterval.
+func (l *clientLimiter) shouldWarn() bool {
+	now := time.Now()
+	if now.Sub(l.lastWarn) < warnInterval {
+		return false
+	}
+	l.lastWarn = now
+	return true
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientLimiter_SeparateBudgets(t *testing.T) {
+	cfg := testConfig()
+	cfg.ClientDataMsgRate = 1 // burst of 2
+	cfg.ClientVoiceMsgRate = 1
+
+	l := newClientLimiter(cfg)
+	data := []byte(`{"type":"chat"}`)
+	voice := []byte{voiceMagic0, voiceMagic1, 0x00}
+
+	for i := 0; i < 2; i++ {
+		if !l.allow(data) {
+			t.Fatalf("data message %d should fit the burst", i)
+		}
+	}
+	if l.allow(data) {
+		t.Error("data flood should be limited")
+	}
+
+	// Exhausting the data budget must not affect voice.
+	if !l.allow(voice) {
+		t.Error("voice should have its own budget")
+	}
+}
+
+func TestClientLimiter_ByteDebt(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxMessageSize = 4096
+	cfg.ClientDataByteRate = 1000
+
+	// A message past the one-second burst passes a full bucket and leaves
+	// the excess owed: nothing passes until it is paid off.
+	l := newClientLimiter(cfg)
+	now := time.Now()
+	if !l.data.bytes.allowN(now, 3000) {
+		t.Fatal("a large message should pass a full byte bucket")
+	}
+	if l.data.bytes.allowN(now.Add(1500*time.Millisecond), 1) {
+		t.Error("byte budget should still be in debt")
+	}
+	if !l.data.bytes.allowN(now.Add(2100*time.Millisecond), 1) {
+		t.Error("byte budget should allow sending once the debt is paid")
+	}
+}
+
+func TestClientLimiter_ByteBurstIsOneSecond(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxMessageSize = 4096
+	cfg.ClientDataByteRate = 100
+
+	// A large MaxMessageSize does not widen the burst for small messages.
+	l := newClientLimiter(cfg)
+	if !l.allow(bytes.Repeat([]byte{'x'}, 100)) {
+		t.Fatal("one second of bytes should pass a fresh byte bucket")
+	}
+	if l.allow(bytes.Repeat([]byte{'x'}, 100)) {
+		t.Error("byte burst should not exceed one second of the rate")
+	}
+}
+
+func TestClientLimiter_Unlimited(t *testing.T) {
+	cfg := testConfig()
+	l := newClientLimiter(cfg)
+	for i := 0; i < 1000; i++ {
+		if !l.allow([]byte("x")) {
+			t.Fatal("zero rates should mean unlimited")
+		}
+	}
+}
+
+func TestClient_ReadPump_RateLimitDisconnect(t *testing.T) {
+	cfg := testConfig()
+	cfg.ClientDataMsgRate = 1
+	cfg.ClientRateAction = "disconnect"
+
+	relay, peer := newTestConnPair(t)
+	c := NewClient(NewHub(cfg), relay, "room", "peer", "guest", "", "127.0.0.1")
+	go c.ReadPump()
+
+	for i := 0; i < 5; i++ {
+		_ = peer.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"flood"}`))
+	}
+
+	_ = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := peer.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected close 1008, got %v", err)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backplane carries room events between relay nodes so that the peers of one
+// room can be connected to different relays. Publish is called from the hub's
+// shard loops and must not block; implementations drop events for a node
+// that cannot keep up and rely on the resync that follows a reconnect.
+type Backplane interface {
+	// Publish sends ev to every other node.
+	Publish(ev *ClusterEvent)
+	// Subscribe registers the handler for events from other nodes. It is
+	// called once, before any event is delivered.
+	Subscribe(fn func(*ClusterEvent))
+	Close() error
+}
+
+// Cluster event types.
+const (
+	clusterJoin       = "join"        // a peer connected to Node
+	clusterLeave      = "leave"       // a peer left Node for good
+	clusterMessage    = "message"     // a message sent by a peer on Node
+	clusterHostKey    = "host_key"    // Node pinned a host key
+	clusterHostRotate = "host_rotate" // Node accepted a host key rotation
+	clusterJTI        = "jti"         // a single-use token was spent on Node
+	clusterRevoke     = "revoke"      // the host revoked tokens or peers
+	clusterRoomLimit  = "room_limit"  // the host's token set the room's max_peers
+	clusterModerate   = "moderate"    // the host kicked, muted or locked
+
+	// Generated locally by the backplane, never sent on the wire.
+	clusterNodeUp   = "node_up"   // a link to Node came up; resync our state
+	clusterNodeDown = "node_down" // Node is gone; forget its peers
+)
+
+// ClusterEvent is one unit of replication between relay nodes.
+type ClusterEvent struct {
+	Type     string      `json:"type"`
+	Node     string      `json:"node"`
+	RoomID   string      `json:"room_id,omitempty"`
+	ConnID   string      `json:"conn_id,omitempty"`
+	Peer     *PeerInfo   `json:"peer,omitempty"`
+	To       []string    `json:"to,omitempty"`
+	Data     []byte      `json:"data,omitempty"`
+	Key      []byte      `json:"key,omitempty"`
+	PinnedAt int64       `json:"pinned_at,omitempty"` // unix nanoseconds
+	JTI      string      `json:"jti,omitempty"`
+	Expires  int64       `json:"expires,omitempty"` // unix seconds
+	Revoke   *Revocation `json:"revoke,omitempty"`
+	MaxPeers int         `json:"max_peers,omitempty"`
+
+	Control    string             `json:"control,omitempty"` // moderation command type
+	Moderation *ModerationCommand `json:"moderation,omitempty"`
+}
+
+// remotePeer is a connection to a room that lives on another node.
+type remotePeer struct {
+	node string
+	info PeerInfo
+}
+
+// SetBackplane connects the hub to a cluster backplane. It must be called
+// before Run.
+func (h *Hub) SetBackplane(bp Backplane) {
+	h.backplane = bp
+	bp.Subscribe(h.receiveClusterEvent)
+}
+
+// publish sends ev to the other nodes, if the hub is clustered.
+func (h *Hub) publish(ev *ClusterEvent) {
+	if h.backplane == nil {
+		return
+	}
+	ev.Node = h.cfg.NodeID
+	metrics.ClusterEvents.Inc(ev.Type, "out")
+	h.backplane.Publish(ev)
+}
+
+// receiveClusterEvent is the backplane's handler. Host keys are applied
+// directly; room events are queued on the owning shard so they are ordered
+// with the room's local joins, leaves and messages.
+func (h *Hub) receiveClusterEvent(ev *ClusterEvent) {
+	metrics.ClusterEvents.Inc(ev.Type, "in")
+	switch ev.Type {
+	case clusterHostKey, clusterHostRotate:
+		h.applyRemoteHostKey(ev)
+	case clusterJTI:
+		h.mu.Lock()
+		h.usedJTIs[ev.RoomID+"\x00"+ev.JTI] = time.Unix(ev.Expires, 0)
+		h.mu.Unlock()
+	case clusterRoomLimit:
+		h.mu.Lock()
+		h.roomLimits[ev.RoomID] = ev.MaxPeers
+		h.mu.Unlock()
+	case clusterNodeUp:
+		h.publishSnapshot()
+	case clusterNodeDown:
+		for _, s := range h.shards {
+			s.clusterCh <- ev
+		}
+	default:
+		h.shardFor(ev.RoomID).clusterCh <- ev
+	}
+}
+
+// applyClusterEvent runs on the shard that owns ev.RoomID (or, for
+// node_down, on every shard).
+func (h *Hub) applyClusterEvent(shard int, ev *ClusterEvent) {
+	switch ev.Type {
+	case clusterJoin:
+		h.mu.Lock()
+		peers, ok := h.remote[ev.RoomID]
+		if !ok {
+			peers = make(map[string]*remotePeer)
+			h.remote[ev.RoomID] = peers
+		}
+		_, known := peers[ev.ConnID]
+		peers[ev.ConnID] = &remotePeer{node: ev.Node, info: *ev.Peer}
+		room := h.rooms[ev.RoomID]
+		h.mu.Unlock()
+
+		// Snapshots replay joins we already know about; only announce new ones.
+		if room != nil && !known {
+			room.Broadcast("", newEnvelope("session:join", ev.Peer.PeerID, ev.Peer))
+		}
+		if ev.Peer.Role == "host" {
+			h.hostArrived(ev.RoomID)
+		}
+
+	case clusterLeave:
+		h.forgetRemotePeer(ev.RoomID, ev.ConnID)
+
+	case clusterRevoke:
+		if ev.Revoke != nil {
+			h.revoke(ev.RoomID, ev.Revoke)
+		}
+
+	case clusterModerate:
+		if ev.Moderation != nil {
+			h.moderate(ev.RoomID, ev.Control, ev.Moderation)
+		}
+
+	case clusterMessage:
+		h.mu.RLock()
+		room := h.rooms[ev.RoomID]
+		h.mu.RUnlock()
+		if room == nil {
+			return
+		}
+		if len(ev.To) == 0 {
+			room.Broadcast("", ev.Data)
+		} else {
+			// Recipients on other nodes are served by those nodes; only the
+			// sender's node reports unknown recipients.
+			room.SendTo("", ev.To, ev.Data)
+		}
+
+	case clusterNodeDown:
+		h.mu.RLock()
+		var gone [][2]string
+		for roomID, peers := range h.remote {
+			if h.shardIndex(roomID) != shard {
+				continue
+			}
+			for connID, p := range peers {
+				if p.node == ev.Node {
+					gone = append(gone, [2]string{roomID, connID})
+				}
+			}
+		}
+		h.mu.RUnlock()
+		for _, g := range gone {
+			h.forgetRemotePeer(g[0], g[1])
+		}
+		if len(gone) > 0 {
+			log.Printf("cluster node %s down, dropped %d remote peers", ev.Node, len(gone))
+		}
+	}
+}
+
+// forgetRemotePeer removes a remote connection and tells local peers it left.
+// The host key pin goes with the last peer anywhere in the cluster.
+func (h *Hub) forgetRemotePeer(roomID, connID string) {
+	h.mu.Lock()
+	p, ok := h.remote[roomID][connID]
+	if ok {
+		delete(h.remote[roomID], connID)
+		if len(h.remote[roomID]) == 0 {
+			delete(h.remote, roomID)
+		}
+	}
+	room := h.rooms[roomID]
+	if ok && room == nil && h.remote[roomID] == nil {
+		h.forgetRoom(roomID)
+	}
+	h.mu.Unlock()
+
+	if ok && room != nil {
+		room.Broadcast("", newEnvelope("session:leave", p.info.PeerID, nil))
+		if p.info.Role == "host" {
+			h.hostLeft(roomID, p.info.PeerID)
+		}
+	}
+}
+
+// remoteCount returns the number of connections to roomID on other nodes.
+// The caller must hold h.mu.
+func (h *Hub) remoteCount(roomID string) int {
+	return len(h.remote[roomID])
+}
+
+// remotePeers lists the peers other nodes have in roomID.
+func (h *Hub) remotePeers(roomID string) []PeerInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	peers := make([]PeerInfo, 0, len(h.remote[roomID]))
+	for _, p := range h.remote[roomID] {
+		peers = append(peers, p.info)
+	}
+	return peers
+}
+
+// hasRemotePeer reports whether any of peerIDs (or, with none given, any
+// peer at all) is connected to roomID on another node.
+func (h *Hub) hasRemotePeer(roomID string, peerIDs []string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(peerIDs) == 0 {
+		return len(h.remote[roomID]) > 0
+	}
+	for _, p := range h.remote[roomID] {
+		for _, id := range peerIDs {
+			if p.info.PeerID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyRemoteHostKey mirrors another node's host key pin. Pins that race on
+// two nodes are resolved the same way everywhere: the earlier pin wins, with
+// the node ID as a tie-breaker. Rotations were verified by the sender.
+func (h *Hub) applyRemoteHostKey(ev *ClusterEvent) {
+	pinnedAt := time.Unix(0, ev.PinnedAt)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hk, ok := h.hostKeys[ev.RoomID]
+	switch {
+	case !ok || ev.Type == clusterHostRotate:
+	case bytes.Equal(hk.key, ev.Key):
+		return
+	case hk.pinnedAt.Before(pinnedAt) || (hk.pinnedAt.Equal(pinnedAt) && h.cfg.NodeID < ev.Node):
+		log.Printf("room %s: ignoring conflicting host key pinned on %s", ev.RoomID, ev.Node)
+		return
+	default:
+		log.Printf("room %s: conflicting host key pinned earlier on %s takes over", ev.RoomID, ev.Node)
+	}
+	h.hostKeys[ev.RoomID] = &hostKey{key: bytes.Clone(ev.Key), pinnedAt: pinnedAt}
+}
+
+// publishSnapshot re-announces every local pin and connection, so a node
+// that (re)joined the mesh learns this node's share of each room.
+func (h *Hub) publishSnapshot() {
+	var events []*ClusterEvent
+	h.mu.RLock()
+	for roomID, hk := range h.hostKeys {
+		events = append(events, &ClusterEvent{Type: clusterHostKey, RoomID: roomID, Key: hk.key, PinnedAt: hk.pinnedAt.UnixNano()})
+		if rev := h.revocations(roomID); rev != nil {
+			events = append(events, &ClusterEvent{Type: clusterRevoke, RoomID: roomID, Revoke: rev})
+		}
+		events = append(events, h.moderationEvents(roomID)...)
+		if n, ok := h.roomLimits[roomID]; ok {
+			events = append(events, &ClusterEvent{Type: clusterRoomLimit, RoomID: roomID, MaxPeers: n})
+		}
+	}
+	for key, expires := range h.usedJTIs {
+		roomID, jti, _ := strings.Cut(key, "\x00")
+		events = append(events, &ClusterEvent{Type: clusterJTI, RoomID: roomID, JTI: jti, Expires: expires.Unix()})
+	}
+	for roomID, room := range h.rooms {
+		for _, c := range room.Clients() {
+			info := c.info()
+			events = append(events, &ClusterEvent{Type: clusterJoin, RoomID: roomID, ConnID: c.connID, Peer: &info})
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, ev := range events {
+		h.publish(ev)
+	}
+}
+
+// MemoryCluster is a backplane for several hubs in one process, used in
+// tests and for running multiple relays side by side without a network.
+type MemoryCluster struct {
+	mu    sync.Mutex
+	nodes map[string]*memoryBackplane
+}
+
+func NewMemoryCluster() *MemoryCluster {
+	return &MemoryCluster{nodes: make(map[string]*memoryBackplane)}
+}
+
+type memoryBackplane struct {
+	cluster *MemoryCluster
+	node    string
+	events  chan *ClusterEvent
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Join adds a node to the cluster and returns its backplane. Every node,
+// including the new one, is told about the other so both sides resync.
+func (mc *MemoryCluster) Join(node string) Backplane {
+	b := &memoryBackplane{
+		cluster: mc,
+		node:    node,
+		events:  make(chan *ClusterEvent, 4096),
+		done:    make(chan struct{}),
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, other := range mc.nodes {
+		other.deliver(&ClusterEvent{Type: clusterNodeUp, Node: node})
+		b.deliver(&ClusterEvent{Type: clusterNodeUp, Node: other.node})
+	}
+	mc.nodes[node] = b
+	return b
+}
+
+func (b *memoryBackplane) deliver(ev *ClusterEvent) {
+	select {
+	case b.events <- ev:
+	default:
+		metrics.ClusterEventsDropped.Inc(b.node)
+	}
+}
+
+func (b *memoryBackplane) Publish(ev *ClusterEvent) {
+	b.cluster.mu.Lock()
+	defer b.cluster.mu.Unlock()
+	for node, other := range b.cluster.nodes {
+		if node != b.node {
+			other.deliver(ev)
+		}
+	}
+}
+
+func (b *memoryBackplane) Subscribe(fn func(*ClusterEvent)) {
+	go func() {
+		for {
+			select {
+			case ev := <-b.events:
+				fn(ev)
+			case <-b.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close leaves the cluster; the remaining nodes drop this node's peers.
+func (b *memoryBackplane) Close() error {
+	b.once.Do(func() {
+		b.cluster.mu.Lock()
+		delete(b.cluster.nodes, b.node)
+		for _, other := range b.cluster.nodes {
+			other.deliver(&ClusterEvent{Type: clusterNodeDown, Node: b.node})
+		}
+		b.cluster.mu.Unlock()
+		close(b.done)
+	})
+	return nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	meshHandshakeTimeout = 10 * time.Second
+	meshWriteTimeout     = 10 * time.Second
+	meshQueueSize        = 4096
+	meshMaxBackoff       = 30 * time.Second
+)
+
+var (
+	errMeshSelf = errors.New("cluster peer is this node")
+	errMeshAuth = errors.New("cluster peer failed authentication")
+)
+
+// TCPMesh is a backplane that connects relay nodes directly over TCP. Every
+// node dials every address in its peer list and accepts connections from the
+// others, so each pair of nodes shares two one-way links: a node publishes on
+// the links it dialed and receives on the links it accepted. Events are
+// newline-delimited JSON.
+//
+// Both ends of a link prove they hold the shared cluster secret with an
+// HMAC over a nonce the other end chose. The mesh carries room traffic in clear text and is
+// meant for a private network.
+type TCPMesh struct {
+	node   string
+	secret []byte
+	ln     net.Listener
+	links  []*meshLink
+
+	ready chan struct{} // closed by Subscribe
+	fn    func(*ClusterEvent)
+
+	mu      sync.Mutex
+	inbound map[string]net.Conn // node ID → accepted connection
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// meshLink is the outbound connection to one peer address.
+type meshLink struct {
+	addr  string
+	node  atomic.Value // string: remote node ID, once known
+	up    atomic.Bool
+	queue chan *ClusterEvent
+}
+
+// meshHello is exchanged before any event: the acceptor sends a nonce, the
+// dialer answers with its node ID, its MAC over that nonce and a nonce of its
+// own, and the acceptor confirms with its node ID and its MAC over the
+// dialer's nonce. Each side thus authenticates the other.
+type meshHello struct {
+	Node  string `json:"node,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+	MAC   string `json:"mac,omitempty"`
+}
+
+// NewTCPMesh listens on listenAddr and starts dialing peers. Delivery starts
+// once Subscribe is called.
+func NewTCPMesh(node, listenAddr string, peers []string, secret string) (*TCPMesh, error) {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	m := &TCPMesh{
+		node:    node,
+		secret:  []byte(secret),
+		ln:      ln,
+		ready:   make(chan struct{}),
+		inbound: make(map[string]net.Conn),
+		done:    make(chan struct{}),
+	}
+	for _, addr := range peers {
+		m.links = append(m.links, &meshLink{addr: addr, queue: make(chan *ClusterEvent, meshQueueSize)})
+	}
+
+	go m.acceptLoop()
+	for _, l := range m.links {
+		go m.dialLoop(l)
+	}
+	return m, nil
+}
+
+// Addr returns the mesh listener's address.
+func (m *TCPMesh) Addr() net.Addr {
+	return m.ln.Addr()
+}
+
+func (m *TCPMesh) Subscribe(fn func(*ClusterEvent)) {
+	m.fn = fn
+	close(m.ready)
+}
+
+// Publish queues ev on every connected link. Events for a link that is down
+// or backed up are dropped; the peer resyncs from a snapshot on reconnect.
+func (m *TCPMesh) Publish(ev *ClusterEvent) {
+	for _, l := range m.links {
+		if !l.up.Load() {
+			continue
+		}
+		select {
+		case l.queue <- ev:
+		default:
+			node, _ := l.node.Load().(string)
+			metrics.ClusterEventsDropped.Inc(node)
+		}
+	}
+}
+
+func (m *TCPMesh) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		_ = m.ln.Close()
+		m.mu.Lock()
+		for _, conn := range m.inbound {
+			_ = conn.Close()
+		}
+		m.mu.Unlock()
+	})
+	return nil
+}
+
+// emit hands a locally generated event to the subscriber.
+func (m *TCPMesh) emit(ev *ClusterEvent) {
+	select {
+	case <-m.ready:
+		m.fn(ev)
+	case <-m.done:
+	}
+}
+
+func (m *TCPMesh) mac(nonce, node string) string {
+	h := hmac.New(sha256.New, m.secret)
+	h.Write([]byte(nonce + "\x00" + node))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (m *TCPMesh) acceptLoop() {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+			log.Printf("cluster accept: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go m.serveInbound(conn)
+	}
+}
+
+// serveInbound authenticates a dialing node and feeds its events to the
+// subscriber until the connection drops, then reports the node as down.
+func (m *TCPMesh) serveInbound(conn net.Conn) {
+	defer conn.Close()
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+
+	_ = conn.SetDeadline(time.Now().Add(meshHandshakeTimeout))
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	var hello meshHello
+	if err := enc.Encode(&meshHello{Nonce: nonce}); err != nil {
+		return
+	}
+	if err := dec.Decode(&hello); err != nil {
+		return
+	}
+	if hello.Node == "" || hello.Nonce == "" || !hmac.Equal([]byte(hello.MAC), []byte(m.mac(nonce, hello.Node))) {
+		log.Printf("cluster: rejected link from %s: bad credentials", conn.RemoteAddr())
+		return
+	}
+	if err := enc.Encode(&meshHello{Node: m.node, MAC: m.mac(hello.Nonce, m.node)}); err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	node := hello.Node
+	if node == m.node {
+		return
+	}
+	m.mu.Lock()
+	if old, ok := m.inbound[node]; ok {
+		_ = old.Close()
+	}
+	m.inbound[node] = conn
+	m.mu.Unlock()
+	log.Printf("cluster: link from node %s (%s) up", node, conn.RemoteAddr())
+
+	for {
+		var ev ClusterEvent
+		if err := dec.Decode(&ev); err != nil {
+			break
+		}
+		if ev.Type == clusterNodeUp || ev.Type == clusterNodeDown {
+			continue // local-only events are never accepted from the wire
+		}
+		ev.Node = node
+		m.emit(&ev)
+	}
+
+	// Only the current link for a node may declare it down; a replaced link
+	// closing late must not wipe the state its successor resynced.
+	m.mu.Lock()
+	current := m.inbound[node] == conn
+	if current {
+		delete(m.inbound, node)
+	}
+	m.mu.Unlock()
+	if current {
+		log.Printf("cluster: link from node %s down", node)
+		m.emit(&ClusterEvent{Type: clusterNodeDown, Node: node})
+	}
+}
+
+// dialLoop keeps the outbound link to l.addr connected, backing off between
+// attempts.
+func (m *TCPMesh) dialLoop(l *meshLink) {
+	backoff := 500 * time.Millisecond
+	for {
+		err := m.runLink(l)
+		if err == errMeshSelf {
+			return
+		}
+		select {
+		case <-m.done:
+			return
+		case <-time.After(backoff):
+		}
+		if err == nil {
+			backoff = 500 * time.Millisecond
+		} else {
+			backoff = min(backoff*2, meshMaxBackoff)
+		}
+	}
+}
+
+// runLink dials l once and writes queued events until the connection fails.
+// It returns nil if the link was established before it dropped.
+func (m *TCPMesh) runLink(l *meshLink) error {
+	conn, err := net.DialTimeout("tcp", l.addr, meshHandshakeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	dec := json.NewDecoder(conn)
+	w := bufio.NewWriter(conn)
+	enc := json.NewEncoder(w)
+
+	_ = conn.SetDeadline(time.Now().Add(meshHandshakeTimeout))
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	var challenge, ack meshHello
+	if err := dec.Decode(&challenge); err != nil {
+		return err
+	}
+	if err := enc.Encode(&meshHello{Node: m.node, MAC: m.mac(challenge.Nonce, m.node), Nonce: nonce}); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := dec.Decode(&ack); err != nil {
+		log.Printf("cluster: link to %s refused", l.addr)
+		return err
+	}
+	if ack.Node == "" || !hmac.Equal([]byte(ack.MAC), []byte(m.mac(nonce, ack.Node))) {
+		log.Printf("cluster: rejected link to %s: bad credentials", l.addr)
+		return errMeshAuth
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if ack.Node == m.node {
+		return errMeshSelf
+	}
+	l.node.Store(ack.Node)
+
+	// Anything queued while the link was down is stale; the snapshot sent
+	// on node_up replaces it.
+	for len(l.queue) > 0 {
+		<-l.queue
+	}
+	l.up.Store(true)
+	defer l.up.Store(false)
+	log.Printf("cluster: link to node %s (%s) up", ack.Node, l.addr)
+	m.emit(&ClusterEvent{Type: clusterNodeUp, Node: ack.Node})
+
+	// The peer never writes after the handshake; a read returning means
+	// the connection is gone.
+	closed := make(chan struct{})
+	go func() {
+		_, _ = conn.Read(make([]byte, 1))
+		close(closed)
+	}()
+
+	for {
+		select {
+		case ev := <-l.queue:
+			// A peer that stops reading must not hold the link forever.
+			_ = conn.SetWriteDeadline(time.Now().Add(meshWriteTimeout))
+			if err := enc.Encode(ev); err != nil {
+				return nil
+			}
+			if len(l.queue) == 0 {
+				if err := w.Flush(); err != nil {
+					return nil
+				}
+			}
+		case <-closed:
+			return nil
+		case <-m.done:
+			return nil
+		}
+	}
+}
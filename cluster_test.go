@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newClusterRelay runs a relay that is a member of mc under the given node ID.
+func newClusterRelay(t *testing.T, mc *MemoryCluster, node string, cfg *Config) *testRelay {
+	t.Helper()
+	nodeCfg := *cfg
+	nodeCfg.NodeID = node
+	hub := NewHub(&nodeCfg)
+	bp := mc.Join(node)
+	hub.SetBackplane(bp)
+	t.Cleanup(func() { bp.Close() })
+	return serveTestRelay(t, &nodeCfg, hub)
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCluster_RoomAcrossNodes(t *testing.T) {
+	mc := NewMemoryCluster()
+	a := newClusterRelay(t, mc, "node-a", testConfig())
+	b := newClusterRelay(t, mc, "node-b", testConfig())
+
+	pub, priv, hostJWT := hostToken(t, "room-1")
+	host := a.dial(t, url.Values{
+		"room":   {"room-1"},
+		"token":  {hostJWT},
+		"pubkey": {base64.RawURLEncoding.EncodeToString(pub)},
+	})
+	readEnvelope(t, host, "session:roster")
+
+	// The guest lands on the other node, which only knows the host key and
+	// the host through the backplane.
+	waitFor(t, "host replication", func() bool { return b.hub.ClientCount("room-1") == 1 })
+	guest := b.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+
+	peers := readEnvelope(t, guest, "session:roster")["payload"].(map[string]any)["peers"].([]any)
+	if len(peers) != 1 || peers[0].(map[string]any)["peer_id"] != "host-1" {
+		t.Fatalf("guest roster = %v, want the remote host", peers)
+	}
+	if join := readEnvelope(t, host, "session:join"); join["from"] != "guest-1" {
+		t.Errorf("join from %v, want guest-1", join["from"])
+	}
+
+	_ = host.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"chat","from":"host-1"}`))
+	readEnvelope(t, guest, "chat")
+	_ = guest.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"dm","from":"guest-1","to":"host-1"}`))
+	readEnvelope(t, host, "dm")
+
+	guest.Close()
+	if leave := readEnvelope(t, host, "session:leave"); leave["from"] != "guest-1" {
+		t.Errorf("leave from %v, want guest-1", leave["from"])
+	}
+}
+
+func TestCluster_MaxClientsPerRoomIsClusterWide(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxClientsPerRoom = 2
+	mc := NewMemoryCluster()
+	a := newClusterRelay(t, mc, "node-a", cfg)
+	b := newClusterRelay(t, mc, "node-b", cfg)
+
+	pub, priv, hostJWT := hostToken(t, "room-1")
+	a.dial(t, url.Values{
+		"room":   {"room-1"},
+		"token":  {hostJWT},
+		"pubkey": {base64.RawURLEncoding.EncodeToString(pub)},
+	})
+	waitFor(t, "host replication", func() bool { return b.hub.ClientCount("room-1") == 1 })
+	b.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	waitFor(t, "guest replication", func() bool { return a.hub.ClientCount("room-1") == 2 })
+
+	q := url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-2")}}
+	_, resp, err := websocket.DefaultDialer.Dial(a.url+"?"+q.Encode(), nil)
+	if err == nil {
+		t.Fatal("third client admitted to a full room")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("response = %v, want 503", resp)
+	}
+}
+
+func TestCluster_NodeDownDropsRemotePeers(t *testing.T) {
+	mc := NewMemoryCluster()
+	a := newClusterRelay(t, mc, "node-a", testConfig())
+
+	nodeCfg := *testConfig()
+	nodeCfg.NodeID = "node-b"
+	hubB := NewHub(&nodeCfg)
+	bpB := mc.Join("node-b")
+	hubB.SetBackplane(bpB)
+	b := serveTestRelay(t, &nodeCfg, hubB)
+
+	pub, priv, hostJWT := hostToken(t, "room-1")
+	host := a.dial(t, url.Values{
+		"room":   {"room-1"},
+		"token":  {hostJWT},
+		"pubkey": {base64.RawURLEncoding.EncodeToString(pub)},
+	})
+	waitFor(t, "host replication", func() bool { return b.hub.ClientCount("room-1") == 1 })
+	b.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	readEnvelope(t, host, "session:join")
+
+	bpB.Close()
+	if leave := readEnvelope(t, host, "session:leave"); leave["from"] != "guest-1" {
+		t.Errorf("leave from %v, want guest-1", leave["from"])
+	}
+	if n := a.hub.ClientCount("room-1"); n != 1 {
+		t.Errorf("client count after node loss = %d, want 1", n)
+	}
+}
+
+func TestTCPMesh_Replicates(t *testing.T) {
+	a, err := NewTCPMesh("node-a", "127.0.0.1:0", nil, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	received := make(chan *ClusterEvent, 16)
+	a.Subscribe(func(ev *ClusterEvent) { received <- ev })
+
+	// node-b lists itself as well; the self link must be discarded.
+	bLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bAddr := bLn.Addr().String()
+	bLn.Close()
+	b, err := NewTCPMesh("node-b", bAddr, []string{a.Addr().String(), bAddr}, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	up := make(chan string, 4)
+	b.Subscribe(func(ev *ClusterEvent) {
+		if ev.Type == clusterNodeUp {
+			up <- ev.Node
+		}
+	})
+
+	select {
+	case node := <-up:
+		if node != "node-a" {
+			t.Fatalf("node_up for %q, want node-a", node)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("link to node-a never came up")
+	}
+
+	b.Publish(&ClusterEvent{Type: clusterMessage, Node: "spoofed", RoomID: "room-1", Data: []byte("hi")})
+	select {
+	case ev := <-received:
+		if ev.Type != clusterMessage || ev.Node != "node-b" || string(ev.Data) != "hi" {
+			t.Errorf("received %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event not delivered")
+	}
+
+	b.Close()
+	select {
+	case ev := <-received:
+		if ev.Type != clusterNodeDown || ev.Node != "node-b" {
+			t.Errorf("received %+v, want node_down for node-b", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("node_down not reported")
+	}
+}
+
+func TestTCPMesh_RejectsWrongSecret(t *testing.T) {
+	a, err := NewTCPMesh("node-a", "127.0.0.1:0", nil, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Subscribe(func(*ClusterEvent) {})
+
+	b, err := NewTCPMesh("node-b", "127.0.0.1:0", []string{a.Addr().String()}, "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	up := make(chan struct{}, 1)
+	b.Subscribe(func(ev *ClusterEvent) {
+		if ev.Type == clusterNodeUp {
+			up <- struct{}{}
+		}
+	})
+
+	select {
+	case <-up:
+		t.Fatal("link with the wrong secret came up")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestTCPMesh_VerifiesAcceptor(t *testing.T) {
+	// An impostor listening on a peer address answers the handshake without
+	// knowing the secret.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+				var hello meshHello
+				_ = enc.Encode(&meshHello{Nonce: "00"})
+				_ = dec.Decode(&hello)
+				_ = enc.Encode(&meshHello{Node: "impostor", MAC: "00"})
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	b, err := NewTCPMesh("node-b", "127.0.0.1:0", []string{ln.Addr().String()}, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	up := make(chan struct{}, 1)
+	b.Subscribe(func(ev *ClusterEvent) {
+		if ev.Type == clusterNodeUp {
+			up <- struct{}{}
+		}
+	})
+
+	select {
+	case <-up:
+		t.Fatal("link to an unauthenticated acceptor came up")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
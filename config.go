@@ -1,8 +1,11 @@
 package main
 
 import (
+	"log"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -13,12 +16,114 @@ type Config struct {
 	MaxRooms          int
 	MaxClientsPerRoom int
 	MaxMessageSize    int64
+	MaxVoiceSize      int64
+	OversizeAction    string // "drop" or "close"
 	RoomIdleTimeout   time.Duration
+	HubShards         int           // hub event loops; 0 = GOMAXPROCS
+	ResumeGrace       time.Duration // how long a dropped connection stays resumable; 0 disables
 	RateLimitPerIP    float64
-	MetricsAddr       string
+
+	// Per-connection budgets (0 = unlimited) and the action taken on a
+	// violation: "drop", "warn" or "disconnect".
+	ClientDataMsgRate   float64
+	ClientDataByteRate  float64
+	ClientVoiceMsgRate  float64
+	ClientVoiceByteRate float64
+	ClientRateAction    string
+
+	MetricsAddr    string
+	AdminAddr      string
+	AdminToken     string
+	TrustedProxies trustedProxies
+	ProxyProtocol  bool
+
+	// Token policy: clock skew tolerance, longest accepted lifetime (0 =
+	// unlimited), and the identities aud and iss are matched against.
+	JWTClockSkew   time.Duration
+	JWTMaxLifetime time.Duration
+	JWTAudience    string
+	JWTIssuer      string
+
+	// AllowQueryToken keeps accepting ?token= for clients that predate the
+	// Authorization header and subprotocol methods.
+	AllowQueryToken bool
+
+	// PostUpgradeAuth lets a client that sends no credentials in the
+	// handshake authenticate with a relay:auth first frame within AuthTimeout.
+	PostUpgradeAuth bool
+	AuthTimeout     time.Duration
+
+	// In rooms whose host token asks for a lobby, guests wait up to
+	// LobbyTimeout for the host's approval, at most LobbyMaxPending at once.
+	LobbyTimeout    time.Duration
+	LobbyMaxPending int
+
+	// HostLeavePolicy is "stay", "close" or "grace"; under "grace" a room
+	// whose host left is closed unless a host returns within HostGrace.
+	HostLeavePolicy string
+	HostGrace       time.Duration
+
+	// SlowConsumerPolicy is the default for rooms whose host token does not
+	// set one: "drop", "disconnect" or "drop_voice".
+	SlowConsumerPolicy string
+
+	// DataQueueBytes and VoiceQueueBytes bound the bytes queued for each
+	// connection, per class; 0 leaves only the message count limit.
+	DataQueueBytes  int64
+	VoiceQueueBytes int64
+
+	// Chunked transfers: chunks carry at most TransferChunkSize bytes of
+	// data, and each recipient gets TransferWindow chunks past its last ack;
+	// the relay holds up to a window more for it before the sender waits.
+	TransferChunkSize int64
+	TransferWindow    int
+
+	// Clustering: NodeID names this relay on the backplane; with ClusterAddr
+	// set, nodes form a TCP mesh with ClusterPeers, authenticated with
+	// ClusterSecret.
+	NodeID        string
+	ClusterAddr   string
+	ClusterPeers  []string
+	ClusterSecret string
+
+	// Placement assigns each room to one node of a static list; requests for
+	// a room owned elsewhere are redirected ("http" 307 or "close" frame).
+	Placement         *placementRing
+	PlacementRedirect string
 }
 
 func LoadConfig() *Config {
+	trusted, err := parseTrustedProxies(envList("RELAY_TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("RELAY_TRUSTED_PROXIES: %v", err)
+	}
+	// Without a trusted list any peer could send a PROXY header and pick its
+	// own source address.
+	proxyProtocol := envBool("RELAY_PROXY_PROTOCOL", false)
+	if proxyProtocol && len(trusted) == 0 {
+		log.Fatalf("RELAY_PROXY_PROTOCOL requires RELAY_TRUSTED_PROXIES")
+	}
+	hostname, _ := os.Hostname()
+	nodeID := envStr("RELAY_NODE_ID", hostname)
+	placement, err := parsePlacement(envList("RELAY_PLACEMENT_NODES"))
+	if err != nil {
+		log.Fatalf("RELAY_PLACEMENT_NODES: %v", err)
+	}
+	// A node missing from the ring owns no room and would redirect every
+	// client away, forever.
+	if placement != nil && placement.urls[nodeID] == "" {
+		log.Fatalf("RELAY_PLACEMENT_NODES: this node (%s) is not in the list; set RELAY_NODE_ID", nodeID)
+	}
+	redirect := envChoice("RELAY_PLACEMENT_REDIRECT", "http", "close")
+	if redirect == "close" && placement != nil {
+		// A close frame reason is limited to 123 bytes.
+		for node, u := range placement.urls {
+			if len(u+"/ws") > 123 {
+				log.Fatalf("RELAY_PLACEMENT_NODES: URL for %s too long for close redirects", node)
+			}
+		}
+	}
+
 	return &Config{
 		Addr:              envStr("RELAY_ADDR", ":8443"),
 		TLSCert:           envStr("RELAY_TLS_CERT", ""),
@@ -26,9 +131,51 @@ func LoadConfig() *Config {
 		MaxRooms:          envInt("RELAY_MAX_ROOMS", 1000),
 		MaxClientsPerRoom: envInt("RELAY_MAX_CLIENTS_PER_ROOM", 20),
 		MaxMessageSize:    int64(envInt("RELAY_MAX_MESSAGE_SIZE", 52428800)),
+		MaxVoiceSize:      int64(envInt("RELAY_MAX_VOICE_SIZE", 65536)),
+		OversizeAction:    envChoice("RELAY_OVERSIZE_ACTION", "close", "drop"),
 		RoomIdleTimeout:   time.Duration(envInt("RELAY_ROOM_IDLE_TIMEOUT", 3600)) * time.Second,
+		HubShards:         envInt("RELAY_HUB_SHARDS", 0),
+		ResumeGrace:       time.Duration(envInt("RELAY_RESUME_GRACE", 30)) * time.Second,
 		RateLimitPerIP:    float64(envInt("RELAY_RATE_LIMIT_PER_IP", 100)),
-		MetricsAddr:       envStr("RELAY_METRICS_ADDR", ""),
+
+		ClientDataMsgRate:   float64(envInt("RELAY_CLIENT_DATA_MSG_RATE", 200)),
+		ClientDataByteRate:  float64(envInt("RELAY_CLIENT_DATA_BYTE_RATE", 0)),
+		ClientVoiceMsgRate:  float64(envInt("RELAY_CLIENT_VOICE_MSG_RATE", 200)),
+		ClientVoiceByteRate: float64(envInt("RELAY_CLIENT_VOICE_BYTE_RATE", 0)),
+		ClientRateAction:    envChoice("RELAY_CLIENT_RATE_ACTION", "drop", "warn", "disconnect"),
+
+		MetricsAddr:    envStr("RELAY_METRICS_ADDR", ""),
+		AdminAddr:      envStr("RELAY_ADMIN_ADDR", ""),
+		AdminToken:     envStr("RELAY_ADMIN_TOKEN", ""),
+		TrustedProxies: trusted,
+		ProxyProtocol:  proxyProtocol,
+
+		JWTClockSkew:   time.Duration(envInt("RELAY_JWT_CLOCK_SKEW", 30)) * time.Second,
+		JWTMaxLifetime: time.Duration(envInt("RELAY_JWT_MAX_LIFETIME", 86400)) * time.Second,
+		JWTAudience:    envStr("RELAY_JWT_AUDIENCE", ""),
+		JWTIssuer:      envStr("RELAY_JWT_ISSUER", ""),
+
+		AllowQueryToken: envBool("RELAY_ALLOW_QUERY_TOKEN", true),
+		PostUpgradeAuth: envBool("RELAY_POST_UPGRADE_AUTH", false),
+		AuthTimeout:     time.Duration(envInt("RELAY_AUTH_TIMEOUT", 10)) * time.Second,
+		LobbyTimeout:    time.Duration(envInt("RELAY_LOBBY_TIMEOUT", 120)) * time.Second,
+		LobbyMaxPending: envInt("RELAY_LOBBY_MAX_PENDING", 20),
+		HostLeavePolicy: envChoice("RELAY_HOST_LEAVE", hostLeaveStay, hostLeaveClose, hostLeaveGrace),
+		HostGrace:       time.Duration(envInt("RELAY_HOST_GRACE", 60)) * time.Second,
+
+		SlowConsumerPolicy: envChoice("RELAY_SLOW_CONSUMER", slowConsumerDrop, slowConsumerDisconnect, slowConsumerDropVoice),
+		DataQueueBytes:     int64(envInt("RELAY_DATA_QUEUE_BYTES", 8<<20)),
+		VoiceQueueBytes:    int64(envInt("RELAY_VOICE_QUEUE_BYTES", 256<<10)),
+		TransferChunkSize:  int64(envInt("RELAY_TRANSFER_CHUNK_SIZE", 256<<10)),
+		TransferWindow:     envInt("RELAY_TRANSFER_WINDOW", 16),
+
+		NodeID:        nodeID,
+		ClusterAddr:   envStr("RELAY_CLUSTER_ADDR", ""),
+		ClusterPeers:  envList("RELAY_CLUSTER_PEERS"),
+		ClusterSecret: envStr("RELAY_CLUSTER_SECRET", ""),
+
+		Placement:         placement,
+		PlacementRedirect: redirect,
 	}
 }
 
@@ -39,6 +186,16 @@ func envStr(key, fallback string) string {
 	return fallback
 }
 
+// envChoice returns key's value, which must be fallback or one of others.
+// An unknown value is fatal, so a typo cannot silently pick a behaviour.
+func envChoice(key, fallback string, others ...string) string {
+	v := envStr(key, fallback)
+	if v != fallback && !slices.Contains(others, v) {
+		log.Fatalf("%s: unknown value %q (want one of %s)", key, v, strings.Join(append([]string{fallback}, others...), ", "))
+	}
+	return v
+}
+
 func envInt(key string, fallback int) int {
 	if v := os.Getenv(key); v != "" {
 		if n, err := strconv.Atoi(v); err == nil {
@@ -47,3 +204,23 @@ func envInt(key string, fallback int) int {
 	}
 	return fallback
 }
+
+func envBool(key string, fallback bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return fallback
+}
+
+// envList splits a comma-separated variable, dropping empty entries.
+func envList(key string) []string {
+	var out []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
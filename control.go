@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+// controlMaxSkew bounds how far a control message's timestamp may be from the
+// relay's clock. Together with the nonce cache it stops a captured message
+// from being replayed later.
+const controlMaxSkew = 5 * time.Minute
+
+// controlTypePrefix marks envelopes addressed to the relay itself. They are
+// never forwarded to the room.
+var controlTypePrefix = []byte(`"relay:`)
+
+// controlMessage is a host instruction to the relay. It is an ordinary
+// envelope whose sig is the pinned host key's signature over
+// ControlSigningMessage, so a guest or a stolen host session without the key
+// cannot forge one.
+type controlMessage struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Ts      int64           `json:"ts"`
+	Nonce   uint64          `json:"nonce"`
+	Payload json.RawMessage `json:"payload"`
+	Sig     []byte          `json:"sig"`
+}
+
+// ControlAck is the payload of the relay:ack sent to the host once a control
+// message has been applied.
+type ControlAck struct {
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type"`
+}
+
+// controlHandler applies a verified control message. It runs on the room's
+// shard and returns a relay error to send back to the host, or nil.
+type controlHandler func(h *Hub, host *Client, payload json.RawMessage) *RelayError
+
+// controlHandlers maps control message types to their handlers.
+var controlHandlers = map[string]controlHandler{}
+
+// isControlMessage reports whether a (non-voice) message is addressed to the
+// relay. Only messages mentioning a relay: type are decoded.
+func isControlMessage(data []byte) bool {
+	if !bytes.Contains(data, controlTypePrefix) {
+		return false
+	}
+	var env struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(data, &env) == nil && len(env.Type) > 6 && env.Type[:6] == "relay:"
+}
+
+// ControlSigningMessage returns the bytes the host key signs for a control
+// message. The payload is signed exactly as sent.
+func ControlSigningMessage(roomID, typ string, ts int64, nonce uint64, payload []byte) []byte {
+	msg := []byte("karmagate-relay/control\x00" + roomID + "\x00" + typ + "\x00" +
+		strconv.FormatInt(ts, 10) + "\x00" + strconv.FormatUint(nonce, 10) + "\x00")
+	return append(msg, payload...)
+}
+
+// SignControl builds a signed control envelope (used by hosts, not relay).
+// Included here for testing convenience.
+func SignControl(hostKey ed25519.PrivateKey, roomID, typ string, nonce uint64, payload any) []byte {
+	raw, _ := json.Marshal(payload)
+	ts := time.Now().UnixMilli()
+	data, _ := json.Marshal(&controlMessage{
+		Type:    typ,
+		Ts:      ts,
+		Nonce:   nonce,
+		Payload: raw,
+		Sig:     ed25519.Sign(hostKey, ControlSigningMessage(roomID, typ, ts, nonce, raw)),
+	})
+	return data
+}
+
+// Control queues a control message from c on its room's shard.
+func (h *Hub) Control(c *Client, data []byte) {
+	h.shardFor(c.roomID).controlCh <- func() {
+		h.handleControl(c, data)
+	}
+}
+
+func (h *Hub) handleControl(c *Client, data []byte) {
+	var msg controlMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		h.rejectControl(c, "", &RelayError{Code: "invalid_control", Message: "malformed control message"})
+		return
+	}
+	if rerr := h.verifyControl(c, &msg); rerr != nil {
+		h.rejectControl(c, msg.Type, rerr)
+		return
+	}
+	handler, ok := controlHandlers[msg.Type]
+	if !ok {
+		h.rejectControl(c, msg.Type, &RelayError{Code: "unknown_control", Message: "unknown control message " + msg.Type})
+		return
+	}
+	if rerr := handler(h, c, msg.Payload); rerr != nil {
+		h.rejectControl(c, msg.Type, rerr)
+		return
+	}
+
+	metrics.ControlMessages.Inc(msg.Type, "ok")
+	c.trySend(newEnvelope("relay:ack", relayPeerID, &ControlAck{ID: msg.ID, Type: msg.Type}))
+}
+
+// verifyControl checks that msg comes from the room's host, is signed by the
+// pinned host key and has not been seen before.
+func (h *Hub) verifyControl(c *Client, msg *controlMessage) *RelayError {
+	if c.role != "host" {
+		return &RelayError{Code: "forbidden", Message: "only the host may send relay control messages"}
+	}
+	key := h.GetHostKey(c.roomID)
+	if len(key) != ed25519.PublicKeySize ||
+		!ed25519.Verify(key, ControlSigningMessage(c.roomID, msg.Type, msg.Ts, msg.Nonce, msg.Payload), msg.Sig) {
+		return &RelayError{Code: "invalid_signature", Message: "control message not signed by the room's host key"}
+	}
+
+	now := time.Now()
+	ts := time.UnixMilli(msg.Ts)
+	if ts.Before(now.Add(-controlMaxSkew)) || ts.After(now.Add(controlMaxSkew)) {
+		return &RelayError{Code: "stale_control", Message: "control message timestamp out of range"}
+	}
+
+	seen := c.roomID + "\x00" + strconv.FormatInt(msg.Ts, 10) + "\x00" + strconv.FormatUint(msg.Nonce, 10)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, dup := h.controlSeen[seen]; dup {
+		return &RelayError{Code: "replayed_control", Message: "control message already applied"}
+	}
+	h.controlSeen[seen] = ts.Add(controlMaxSkew)
+	return nil
+}
+
+func (h *Hub) rejectControl(c *Client, typ string, rerr *RelayError) {
+	metrics.ControlMessages.Inc(typ, rerr.Code)
+	log.Printf("control %q from peer %s in room %s rejected: %s", typ, c.PeerID(), c.roomID, rerr.Code)
+	c.trySend(newRelayError(rerr))
+}
+
+// pruneControlSeen forgets nonces whose messages would now be rejected as
+// stale. The caller must hold h.mu.
+func (h *Hub) pruneControlSeen(now time.Time) {
+	for key, expires := range h.controlSeen {
+		if now.After(expires) {
+			delete(h.controlSeen, key)
+		}
+	}
+}
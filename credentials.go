@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// subprotocol is the WebSocket subprotocol the relay speaks. Browser
+	// clients offer it alongside a token entry so the handshake can echo it.
+	subprotocol = "karmagate.v1"
+
+	// subprotocolRecords is karmagate.v1 with length-prefixed batches; see
+	// framing.go. Clients that offer it first get it.
+	subprotocolRecords = "karmagate.v2"
+
+	// subprotocolTokenPrefix carries the JWT in Sec-WebSocket-Protocol for
+	// browsers, which cannot set an Authorization header on a WebSocket.
+	subprotocolTokenPrefix = "karmagate.token."
+)
+
+// Credential sources, in order of precedence. They are also the values of
+// the relay_auth_method_total metric.
+const (
+	authMethodHeader      = "header"
+	authMethodSubprotocol = "subprotocol"
+	authMethodQuery       = "query"
+)
+
+// requestToken returns the JWT presented with r and how it was sent. A
+// query-string token is ignored, with method "query", when the legacy
+// fallback is disabled, so the caller can reject it with a specific reason.
+func (s *Server) requestToken(r *http.Request) (token, method string) {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:]), authMethodHeader
+	}
+	for _, p := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(p, subprotocolTokenPrefix) {
+			return p[len(subprotocolTokenPrefix):], authMethodSubprotocol
+		}
+	}
+	if t := r.URL.Query().Get("token"); t != "" {
+		if !s.cfg.AllowQueryToken {
+			return "", authMethodQuery
+		}
+		return t, authMethodQuery
+	}
+	return "", ""
+}
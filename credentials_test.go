@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHandleWS_TokenFromHeader(t *testing.T) {
+	cfg := testConfig()
+	cfg.AllowQueryToken = false
+	tr := newTestRelay(t, cfg)
+
+	pub, _, hostJWT := hostToken(t, "room-1")
+	q := url.Values{"room": {"room-1"}, "pubkey": {base64.RawURLEncoding.EncodeToString(pub)}}
+
+	before := metrics.AuthMethods.Value(authMethodHeader)
+	conn, _, err := websocket.DefaultDialer.Dial(tr.url+"?"+q.Encode(), http.Header{"Authorization": {"Bearer " + hostJWT}})
+	if err != nil {
+		t.Fatalf("dial with Authorization header: %v", err)
+	}
+	defer conn.Close()
+	readEnvelope(t, conn, "session:roster")
+	if got := metrics.AuthMethods.Value(authMethodHeader) - before; got != 1 {
+		t.Errorf("header auth count = %d, want 1", got)
+	}
+}
+
+func TestHandleWS_TokenFromSubprotocol(t *testing.T) {
+	cfg := testConfig()
+	cfg.AllowQueryToken = false
+	tr := newTestRelay(t, cfg)
+
+	pub, _, hostJWT := hostToken(t, "room-1")
+	q := url.Values{"room": {"room-1"}, "pubkey": {base64.RawURLEncoding.EncodeToString(pub)}}
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{subprotocol, subprotocolTokenPrefix + hostJWT}
+	conn, resp, err := dialer.Dial(tr.url+"?"+q.Encode(), nil)
+	if err != nil {
+		t.Fatalf("dial with subprotocol token: %v", err)
+	}
+	defer conn.Close()
+
+	// Browsers fail the connection unless the server picks one of the
+	// offered protocols; the token entry must never be echoed.
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != subprotocol {
+		t.Errorf("negotiated subprotocol = %q, want %q", got, subprotocol)
+	}
+	readEnvelope(t, conn, "session:roster")
+}
+
+func TestHandleWS_QueryTokenDisabled(t *testing.T) {
+	cfg := testConfig()
+	cfg.AllowQueryToken = false
+	tr := newTestRelay(t, cfg)
+
+	pub, _, hostJWT := hostToken(t, "room-1")
+	before := metrics.HandshakeRejections.Value("query_token_disabled")
+	status := tr.dialStatus(t, url.Values{
+		"room":   {"room-1"},
+		"token":  {hostJWT},
+		"pubkey": {base64.RawURLEncoding.EncodeToString(pub)},
+	})
+	if status != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", status)
+	}
+	if got := metrics.HandshakeRejections.Value("query_token_disabled") - before; got != 1 {
+		t.Errorf("query_token_disabled rejections = %d, want 1", got)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// relayPeerID is the "from" value of envelopes originated by the relay itself
+// rather than forwarded on behalf of a peer.
+const relayPeerID = "relay"
+
+// Envelope mirrors the client-side message envelope. The relay only builds
+// these for its own notifications; forwarded traffic is never decoded into it.
+type Envelope struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	From    string `json:"from"`
+	Ts      int64  `json:"ts"`
+	Nonce   uint64 `json:"nonce"`
+	Payload any    `json:"payload"`
+	Sig     []byte `json:"sig"`
+}
+
+// RelayError is the payload of a relay:error envelope.
+type RelayError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Size    int64  `json:"size,omitempty"`
+	Limit   int64  `json:"limit,omitempty"`
+
+	Peers []string `json:"peers,omitempty"`
+}
+
+// newEnvelope encodes an unsigned envelope of the given type.
+func newEnvelope(typ, from string, payload any) []byte {
+	data, err := json.Marshal(&Envelope{
+		Type:    typ,
+		From:    from,
+		Ts:      time.Now().UnixMilli(),
+		Payload: payload,
+	})
+	if err != nil {
+		// Payloads are relay-defined structs; this cannot fail in practice.
+		panic(err)
+	}
+	return data
+}
+
+// newRelayError encodes a relay:error envelope addressed to a single client.
+func newRelayError(e *RelayError) []byte {
+	return newEnvelope("relay:error", relayPeerID, e)
+}
+
+// PeerInfo describes a connected peer in session:join and session:roster.
+type PeerInfo struct {
+	PeerID string `json:"peer_id"`
+	Role   string `json:"role"`
+	Name   string `json:"name,omitempty"`
+}
+
+// Roster is the payload of session:roster, sent to each newcomer.
+type Roster struct {
+	Peers []PeerInfo `json:"peers"`
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// frameBufSize is the capacity of a new pooled buffer: enough for any voice
+// frame without growing.
+const frameBufSize = 2 << 10
+
+// frameBufMaxPooled bounds the buffers returned to the pool, so one large
+// message does not pin its memory for the life of the process.
+const frameBufMaxPooled = 64 << 10
+
+// frameBuf is a pooled, reference-counted message buffer. ReadPump reads
+// every message into one; a voice frame then fans out to the room without
+// being copied, encoded once as a PreparedMessage shared by all recipients.
+// Each holder releases its reference and the last one returns the buffer to
+// the pool. A buffer lost with a closed client is simply garbage collected.
+type frameBuf struct {
+	b    []byte
+	refs atomic.Int32
+
+	// pm and pmRecord are the frame encoded for newline and records
+	// framing; record holds the frame with its length prefix. They are set
+	// by prepare, and left nil for a frame sent to one peer.
+	pm       *websocket.PreparedMessage
+	pmRecord *websocket.PreparedMessage
+	record   []byte
+}
+
+var framePool = sync.Pool{
+	New: func() any { return &frameBuf{b: make([]byte, 0, frameBufSize)} },
+}
+
+// newFrameBuf returns an empty buffer holding one reference.
+func newFrameBuf() *frameBuf {
+	f := framePool.Get().(*frameBuf)
+	f.refs.Store(1)
+	return f
+}
+
+// frameOf returns a pooled copy of data.
+func frameOf(data []byte) *frameBuf {
+	f := newFrameBuf()
+	f.b = append(f.b, data...)
+	return f
+}
+
+func (f *frameBuf) retain() {
+	f.refs.Add(1)
+}
+
+func (f *frameBuf) release() {
+	if f.refs.Add(-1) != 0 {
+		return
+	}
+	if cap(f.b) > frameBufMaxPooled || cap(f.record) > frameBufMaxPooled {
+		return
+	}
+	f.b = f.b[:0]
+	f.record = f.record[:0]
+	f.pm, f.pmRecord = nil, nil
+	framePool.Put(f)
+}
+
+// prepare encodes the frame once for all the recipients of a broadcast in
+// each framing they use. It must be called before the frame is queued for
+// anyone.
+func (f *frameBuf) prepare(newline, records bool) {
+	if newline {
+		f.pm, _ = websocket.NewPreparedMessage(websocket.BinaryMessage, f.b)
+	}
+	if records {
+		f.record = appendRecord(f.record[:0], f.b)
+		f.pmRecord, _ = websocket.NewPreparedMessage(websocket.BinaryMessage, f.record)
+	}
+}
+
+// write writes the frame to conn as a message of its own, as a record if
+// records is set.
+func (f *frameBuf) write(conn *websocket.Conn, records bool) error {
+	switch {
+	case records && f.pmRecord != nil:
+		return conn.WritePreparedMessage(f.pmRecord)
+	case records:
+		return conn.WriteMessage(websocket.BinaryMessage, appendRecord(nil, f.b))
+	case f.pm != nil:
+		return conn.WritePreparedMessage(f.pm)
+	default:
+		return conn.WriteMessage(websocket.BinaryMessage, f.b)
+	}
+}
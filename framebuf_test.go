@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRoom_BroadcastFrameShared(t *testing.T) {
+	room := NewRoom("room-1")
+	sender := &Client{peerID: "sender", connID: "conn-0", voice: make(chan *frameBuf, 1)}
+	room.Add(sender)
+	var peers []*Client
+	for i := range 3 {
+		c := &Client{peerID: fmt.Sprint("peer-", i), connID: fmt.Sprint("conn-", i+1), voice: make(chan *frameBuf, 1)}
+		room.Add(c)
+		peers = append(peers, c)
+	}
+
+	f := frameOf([]byte{voiceMagic0, voiceMagic1, 1, 2, 3})
+	room.broadcastFrame("conn-0", f)
+	f.release()
+
+	// Every recipient holds the same buffer, encoded once; the sender's
+	// reference is gone.
+	if got := f.refs.Load(); got != 3 {
+		t.Fatalf("refs = %d, want one per recipient", got)
+	}
+	if f.pm == nil {
+		t.Fatal("broadcast frame was not prepared")
+	}
+	for _, c := range peers {
+		if got := <-c.voice; got != f {
+			t.Errorf("%s got a different buffer", c.peerID)
+		}
+		f.release()
+	}
+	if len(sender.voice) != 0 {
+		t.Error("sender got its own voice frame")
+	}
+}
+
+func voiceBenchRoom(b *testing.B, peers int) (*Room, []*Client) {
+	b.Helper()
+	room := NewRoom("bench-room")
+	clients := make([]*Client, peers+1)
+	for i := range clients {
+		clients[i] = &Client{peerID: fmt.Sprint("peer-", i), connID: fmt.Sprint("conn-", i), send: make(chan []byte, 1), voice: make(chan *frameBuf, 1)}
+		room.Add(clients[i])
+	}
+	return room, clients[1:]
+}
+
+// BenchmarkRoom_BroadcastVoice measures one voice frame fanned out to eight
+// peers, from the pooled read buffer to each peer's queue and back.
+func BenchmarkRoom_BroadcastVoice(b *testing.B) {
+	room, peers := voiceBenchRoom(b, 8)
+	frame := append([]byte{voiceMagic0, voiceMagic1}, make([]byte, 160)...)
+
+	b.ReportAllocs()
+	for range b.N {
+		f := newFrameBuf()
+		f.b = append(f.b, frame...)
+		room.broadcastFrame("conn-0", f)
+		f.release()
+		for _, c := range peers {
+			(<-c.voice).release()
+		}
+	}
+}
+
+// BenchmarkRelay_Voice measures a voice frame relayed end to end, from the
+// sender's socket to four peers' sockets. Allocations include the test's
+// own WebSocket clients.
+func BenchmarkRelay_Voice(b *testing.B) {
+	const numPeers = 4
+	cfg := testConfig()
+	cfg.MaxVoiceSize = 4096
+	tr := newTestRelay(b, cfg)
+	host, priv := joinAsHost(b, tr, "room-1")
+	peers := make([]*websocket.Conn, numPeers)
+	for i := range peers {
+		peers[i] = tr.dial(b, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", fmt.Sprint("guest-", i))}})
+		readEnvelope(b, peers[i], "session:roster")
+	}
+	frame := append([]byte{voiceMagic0, voiceMagic1}, make([]byte, 160)...)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if err := host.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			b.Fatal(err)
+		}
+		for _, p := range peers {
+			readVoice(b, p)
+		}
+	}
+	b.ReportMetric(float64(b.N*numPeers)/b.Elapsed().Seconds(), "deliveries/s")
+}
+
+// readVoice skips to the next voice frame on conn without buffering it.
+func readVoice(b *testing.B, conn *websocket.Conn) {
+	var head [2]byte
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, r, err := conn.NextReader()
+		if err != nil {
+			b.Fatal(err)
+		}
+		n, _ := io.ReadFull(r, head[:])
+		_, _ = io.Copy(io.Discard, r)
+		if isVoicePacket(head[:n]) {
+			return
+		}
+	}
+}
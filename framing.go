@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Framing modes, negotiated with the WebSocket subprotocol. Both decide how
+// the relay batches several messages into one WebSocket message; what a
+// client sends is always one message per WebSocket message.
+//
+// In newline framing (karmagate.v1, or no subprotocol) batched messages are
+// separated by '\n'. That is only safe for JSON, so voice frames and
+// transfer chunks are never batched.
+//
+// In records framing (karmagate.v2) every WebSocket message from the relay,
+// voice included, is a sequence of records: the message's length as a
+// big-endian uint32, then the message. Any payload can be batched.
+const (
+	framingNewline = "newline"
+	framingRecords = "records"
+)
+
+// recordHeaderSize is the length prefix of a record.
+const recordHeaderSize = 4
+
+// appendRecord appends msg to dst as a record.
+func appendRecord(dst, msg []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(msg)))
+	return append(dst, msg...)
+}
+
+// framing returns the client's framing mode, as a metrics label.
+func (c *Client) framing() string {
+	if c.records {
+		return framingRecords
+	}
+	return framingNewline
+}
+
+// writeRecord writes message to a batch: as is in newline framing, behind
+// its length in records framing. Only WritePump may call it.
+func (c *Client) writeRecord(w io.Writer, message []byte) error {
+	if c.records {
+		binary.BigEndian.PutUint32(c.recordHeader[:], uint32(len(message)))
+		if _, err := w.Write(c.recordHeader[:]); err != nil {
+			return err
+		}
+	}
+	return writeChunked(c.conn, w, message)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// splitRecords splits a records-framed WebSocket message into its messages.
+func splitRecords(t *testing.T, frame []byte) [][]byte {
+	t.Helper()
+	var msgs [][]byte
+	for len(frame) > 0 {
+		if len(frame) < recordHeaderSize {
+			t.Fatalf("truncated record header: %v", frame)
+		}
+		n := int(binary.BigEndian.Uint32(frame))
+		frame = frame[recordHeaderSize:]
+		if n > len(frame) {
+			t.Fatalf("record of %d bytes in %d remaining", n, len(frame))
+		}
+		msgs = append(msgs, frame[:n])
+		frame = frame[n:]
+	}
+	return msgs
+}
+
+func TestClient_WritePump_Records(t *testing.T) {
+	relay, peer := newTestConnPair(t)
+	c := NewClient(NewHub(testConfig()), relay, "room", "peer", "guest", "", "127.0.0.1")
+	c.records = true
+
+	// Binary data with newlines and a transfer chunk batch safely.
+	binaryData := []byte{0x00, '\n', 0xFF, '\n'}
+	chunk := chunkFrame("t1", 0, []byte("a\nb"))
+	want := [][]byte{[]byte(`{"n":1}`), binaryData, chunk, {}}
+	for _, m := range want {
+		c.trySend(m)
+	}
+	voice := []byte{voiceMagic0, voiceMagic1, '\n'}
+	c.trySend(voice)
+	go c.WritePump()
+	defer c.stop()
+
+	frames := readFrames(t, peer, 2)
+	if got := splitRecords(t, frames[0]); len(got) != 1 || !bytes.Equal(got[0], voice) {
+		t.Errorf("first frame = %q, want the voice frame as one record", got)
+	}
+	got := splitRecords(t, frames[1])
+	if len(got) != len(want) {
+		t.Fatalf("batch has %d records, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("record %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestHandleWS_NegotiateRecords(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxVoiceSize = 1024
+	tr := newTestRelay(t, cfg)
+	host, priv := joinAsHost(t, tr, "room-1")
+
+	before := metrics.Framing.Value(framingRecords)
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocolRecords, subprotocol}}
+	q := url.Values{"room": {"room-1"}}
+	guest, resp, err := dialer.Dial(tr.url+"?"+q.Encode(), http.Header{"Authorization": {"Bearer " + guestToken(priv, "room-1", "guest-1")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guest.Close()
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != subprotocolRecords {
+		t.Fatalf("negotiated %q, want %q", got, subprotocolRecords)
+	}
+	if got := metrics.Framing.Value(framingRecords) - before; got != 1 {
+		t.Errorf("relay_framing_total{mode=records} = %d, want 1", got)
+	}
+	readEnvelope(t, host, "session:join")
+
+	// Voice reaches the records client as a record and the newline client
+	// as a bare frame, from the same broadcast.
+	voice := []byte{voiceMagic0, voiceMagic1, 1, '\n', 2}
+	_ = guest.WriteMessage(websocket.BinaryMessage, voice)
+	_ = host.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, msg, err := host.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isVoicePacket(msg) {
+			if !bytes.Equal(msg, voice) {
+				t.Errorf("host got voice %v, want %v", msg, voice)
+			}
+			break
+		}
+	}
+
+	payload := []byte{0x00, '\n', 0x01}
+	_ = host.WriteMessage(websocket.BinaryMessage, payload)
+	_ = host.WriteMessage(websocket.BinaryMessage, voice)
+	// Voice and data may arrive in either order, but both arrive intact.
+	_ = guest.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var gotPayload, gotVoice bool
+	for !gotPayload || !gotVoice {
+		_, frame, err := guest.ReadMessage()
+		if err != nil {
+			t.Fatalf("payload=%v voice=%v: %v", gotPayload, gotVoice, err)
+		}
+		for _, m := range splitRecords(t, frame) {
+			gotPayload = gotPayload || bytes.Equal(m, payload)
+			gotVoice = gotVoice || bytes.Equal(m, voice)
+		}
+	}
+}
@@ -3,6 +3,6 @@ module github.com/Karmagate/KarmaGateRelay
 go 1.25.4
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
-	golang.org/x/time v0.14.0 // indirect
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/time v0.14.0
 )
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Host leave policies (RELAY_HOST_LEAVE): what happens to a room once its
+// last host connection is gone.
+const (
+	hostLeaveStay  = "stay"  // guests stay and may keep joining
+	hostLeaveClose = "close" // the room is closed
+	hostLeaveGrace = "grace" // the room is closed unless a host returns within HostGrace
+)
+
+// HostLeft is the payload of session:host_left.
+type HostLeft struct {
+	Policy  string `json:"policy"`
+	GraceMs int64  `json:"grace_ms,omitempty"`
+}
+
+// HostChanged is the payload of session:host_changed: the room is now pinned
+// to the successor key the previous host designated.
+type HostChanged struct {
+	PubKey string `json:"pubkey"` // base64url Ed25519 public key
+}
+
+func init() {
+	controlHandlers["relay:successor"] = func(h *Hub, host *Client, payload json.RawMessage) *RelayError {
+		var cmd ModerationCommand
+		if err := json.Unmarshal(payload, &cmd); err != nil {
+			return &RelayError{Code: "invalid_control", Message: "malformed relay:successor payload"}
+		}
+		if cmd.PubKey != "" {
+			key, err := base64.RawURLEncoding.DecodeString(cmd.PubKey)
+			if err != nil || len(key) != 32 {
+				return &RelayError{Code: "invalid_control", Message: "relay:successor needs a base64url Ed25519 pubkey"}
+			}
+		}
+		h.moderate(host.roomID, "relay:successor", &cmd)
+		h.publish(&ClusterEvent{Type: clusterModerate, RoomID: host.roomID, Control: "relay:successor", Moderation: &cmd})
+		return nil
+	}
+}
+
+// hostCount returns the number of host connections to roomID on all nodes.
+// The caller must hold h.mu.
+func (h *Hub) hostCount(roomID string) int {
+	n := 0
+	if room := h.rooms[roomID]; room != nil {
+		for _, c := range room.Clients() {
+			if c.role == "host" {
+				n++
+			}
+		}
+	}
+	for _, p := range h.remote[roomID] {
+		if p.info.Role == "host" {
+			n++
+		}
+	}
+	return n
+}
+
+// hostLeft applies the host leave policy once the last host of roomID is
+// gone. Every node applies it to its own peers. A designated successor key
+// is pinned first, and the room is then kept for HostGrace, even under the
+// close policy, so the successor can connect. It runs on the room's shard.
+func (h *Hub) hostLeft(roomID, peerID string) {
+	h.mu.Lock()
+	room := h.rooms[roomID]
+	if room == nil || h.hostCount(roomID) > 0 {
+		h.mu.Unlock()
+		return
+	}
+	m := h.moderationFor(roomID)
+	successor := m.successor
+	if successor != nil {
+		h.hostKeys[roomID] = &hostKey{key: successor, pinnedAt: time.Now()}
+		m.successor = nil
+	}
+	policy := h.cfg.HostLeavePolicy
+	if successor != nil && policy == hostLeaveClose {
+		policy = hostLeaveGrace
+	}
+	left := &HostLeft{Policy: policy}
+	if policy == hostLeaveGrace {
+		m.hostAway = true
+		m.hostAwayGen++
+		gen := m.hostAwayGen
+		left.GraceMs = h.cfg.HostGrace.Milliseconds()
+		time.AfterFunc(h.cfg.HostGrace, func() {
+			h.shardFor(roomID).controlCh <- func() { h.hostGraceExpired(roomID, gen) }
+		})
+	} else if policy != hostLeaveClose {
+		left.Policy = hostLeaveStay
+	}
+	h.mu.Unlock()
+
+	log.Printf("room %s: host left (policy=%s, successor=%v)", roomID, left.Policy, successor != nil)
+	room.Broadcast("", newEnvelope("session:host_left", peerID, left))
+	if successor != nil {
+		room.Broadcast("", newEnvelope("session:host_changed", relayPeerID,
+			&HostChanged{PubKey: base64.RawURLEncoding.EncodeToString(successor)}))
+	}
+	if policy == hostLeaveClose {
+		h.closeRoom(roomID, websocket.CloseNormalClosure, "host left")
+	}
+}
+
+// hostGraceExpired closes roomID if no host has returned since the grace
+// period numbered gen started.
+func (h *Hub) hostGraceExpired(roomID string, gen uint64) {
+	h.mu.Lock()
+	m, ok := h.moderation[roomID]
+	expired := ok && m.hostAway && m.hostAwayGen == gen
+	if expired {
+		m.hostAway = false
+	}
+	h.mu.Unlock()
+	if expired {
+		h.closeRoom(roomID, websocket.CloseNormalClosure, "host did not return")
+	}
+}
+
+// hostArrived ends a grace period, if any. It runs on the room's shard.
+func (h *Hub) hostArrived(roomID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if m, ok := h.moderation[roomID]; ok && m.hostAway {
+		m.hostAway = false
+		m.hostAwayGen++
+	}
+}
+
+// HostAway reports whether roomID is waiting for its host to return. New
+// guests are refused meanwhile.
+func (h *Hub) HostAway(roomID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	m, ok := h.moderation[roomID]
+	return ok && m.hostAway
+}
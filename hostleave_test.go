@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHostLeave_Close(t *testing.T) {
+	cfg := testConfig()
+	cfg.HostLeavePolicy = hostLeaveClose
+	tr := newTestRelay(t, cfg)
+	host, priv := joinAsHost(t, tr, "room-1")
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	readEnvelope(t, guest, "session:roster")
+
+	host.Close()
+	if e := readEnvelope(t, guest, "session:host_left"); e["payload"].(map[string]any)["policy"] != hostLeaveClose {
+		t.Errorf("host_left = %v", e["payload"])
+	}
+	expectClose(t, guest, websocket.CloseNormalClosure, "host left")
+	if tr.hub.GetHostKey("room-1") != nil {
+		t.Error("host key still pinned after the room closed")
+	}
+}
+
+func TestHostLeave_Grace(t *testing.T) {
+	cfg := testConfig()
+	cfg.HostLeavePolicy = hostLeaveGrace
+	cfg.HostGrace = 300 * time.Millisecond
+	tr := newTestRelay(t, cfg)
+
+	pub, priv, hostJWT := hostToken(t, "room-1")
+	hostQuery := url.Values{"room": {"room-1"}, "token": {hostJWT}, "pubkey": {base64.RawURLEncoding.EncodeToString(pub)}}
+	host := tr.dial(t, hostQuery)
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	readEnvelope(t, guest, "session:roster")
+
+	host.Close()
+	if e := readEnvelope(t, guest, "session:host_left"); e["payload"].(map[string]any)["grace_ms"] != float64(300) {
+		t.Errorf("host_left = %v", e["payload"])
+	}
+	newGuest := url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-2")}}
+	if status := tr.dialStatus(t, newGuest); status != http.StatusServiceUnavailable {
+		t.Errorf("guest while host away status = %d, want 503", status)
+	}
+	bogus := url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-3")}, "resume": {"bogus"}}
+	if status := tr.dialStatus(t, bogus); status != http.StatusServiceUnavailable {
+		t.Errorf("bogus resume while host away status = %d, want 503", status)
+	}
+
+	// The host returns in time; the room carries on past the grace period.
+	host = tr.dial(t, hostQuery)
+	readEnvelope(t, guest, "session:join")
+	tr.dial(t, newGuest)
+	time.Sleep(400 * time.Millisecond)
+	if got := tr.hub.ClientCount("room-1"); got != 3 {
+		t.Fatalf("ClientCount = %d after the host returned, want 3", got)
+	}
+
+	host.Close()
+	readEnvelope(t, guest, "session:host_left")
+	expectClose(t, guest, websocket.CloseNormalClosure, "host did not return")
+}
+
+func TestHostLeave_Successor(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	host, priv := joinAsHost(t, tr, "room-1")
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	readEnvelope(t, guest, "session:roster")
+
+	nextPub, nextPriv, _ := ed25519.GenerateKey(rand.Reader)
+	nextKey := base64.RawURLEncoding.EncodeToString(nextPub)
+	_ = host.WriteMessage(websocket.BinaryMessage,
+		SignControl(priv, "room-1", "relay:successor", 1, &ModerationCommand{PubKey: nextKey}))
+	readEnvelope(t, host, "relay:ack")
+
+	host.Close()
+	if e := readEnvelope(t, guest, "session:host_changed"); e["payload"].(map[string]any)["pubkey"] != nextKey {
+		t.Errorf("host_changed = %v", e["payload"])
+	}
+
+	// Invites signed with the old key are dead; the successor takes over.
+	if status := tr.dialStatus(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-2")}}); status != http.StatusUnauthorized {
+		t.Errorf("old invite status = %d, want 401", status)
+	}
+	successor := SignJWT(&Claims{
+		RoomID:    "room-1",
+		PeerID:    "guest-1",
+		Role:      "host",
+		CreatedAt: time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}, nextPriv)
+	tr.dial(t, url.Values{"room": {"room-1"}, "token": {successor}, "pubkey": {nextKey}})
+	readEnvelope(t, guest, "session:join")
+}
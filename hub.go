@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"fmt"
+	"crypto/ed25519"
+	"errors"
+	"hash/fnv"
 	"log"
+	"net/http"
+	"runtime"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,79 +20,234 @@ type Hub struct {
 
 	mu       sync.RWMutex
 	rooms    map[string]*Room
-	hostKeys map[string][]byte // room_id → host Ed25519 public key
+	hostKeys map[string]*hostKey // room_id → pinned host Ed25519 public key
 
+	resumeTokens map[string]*Client // resumption token → client
+
+	denied      map[string]*denyList // room_id → host-revoked tokens and peers
+	usedJTIs    map[string]time.Time // room_id + jti of spent single-use tokens → expiry
+	controlSeen map[string]time.Time // room_id + ts + nonce of applied control messages → expiry
+	roomLimits  map[string]int       // room_id → max_peers set by the host's token
+	moderation  map[string]*roomModeration
+	lobbies     map[string]map[string]*lobbyEntry // room_id → conn_id → guest awaiting approval
+
+	draining atomic.Bool // refuse new rooms, let existing ones finish
+
+	// Clustering: the backplane is nil on a standalone relay. remote holds
+	// the peers other nodes have in each room (room_id → conn_id → peer).
+	backplane Backplane
+	remote    map[string]map[string]*remotePeer
+
+	shards []*hubShard
+}
+
+// hubShard runs the event loop for the rooms whose IDs hash to it. Every event
+// for a room goes through the same shard, so joins, leaves and messages within
+// a room stay ordered while rooms on different shards are served in parallel.
+type hubShard struct {
+	index        int
 	registerCh   chan *Client
 	unregisterCh chan *Client
 	broadcastCh  chan *BroadcastMsg
+	resumeCh     chan *resumeRequest
+	expireCh     chan *Client
+	controlCh    chan func()
+	clusterCh    chan *ClusterEvent
+}
+
+// hostKey is a room's pinned host public key. The first key presented for a
+// room is pinned until the room is destroyed; it can only be replaced by a
+// rotation statement signed with the pinned key.
+type hostKey struct {
+	key      []byte
+	pinnedAt time.Time
 }
 
+var (
+	ErrHostKeyConflict = errors.New("room is pinned to a different host key")
+	ErrInvalidRotation = errors.New("invalid host key rotation signature")
+)
+
 type BroadcastMsg struct {
 	RoomID   string
 	SenderID string
+	To       []string // recipient peer IDs; empty means the whole room
 	Data     []byte
+
+	// frame is Data's pooled buffer when Data is a voice frame read by
+	// ReadPump. The broadcast owns a reference to it.
+	frame *frameBuf
 }
 
 func NewHub(cfg *Config) *Hub {
-	return &Hub{
-		cfg:          cfg,
-		rooms:        make(map[string]*Room),
-		hostKeys:     make(map[string][]byte),
-		registerCh:   make(chan *Client, 64),
-		unregisterCh: make(chan *Client, 64),
-		broadcastCh:  make(chan *BroadcastMsg, 2048),
+	n := cfg.HubShards
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+
+	h := &Hub{
+		cfg:      cfg,
+		rooms:    make(map[string]*Room),
+		hostKeys: make(map[string]*hostKey),
+		shards:   make([]*hubShard, n),
+
+		resumeTokens: make(map[string]*Client),
+		remote:       make(map[string]map[string]*remotePeer),
+		denied:       make(map[string]*denyList),
+		usedJTIs:     make(map[string]time.Time),
+		controlSeen:  make(map[string]time.Time),
+		roomLimits:   make(map[string]int),
+		moderation:   make(map[string]*roomModeration),
+		lobbies:      make(map[string]map[string]*lobbyEntry),
 	}
+	for i := range h.shards {
+		h.shards[i] = &hubShard{
+			index:        i,
+			registerCh:   make(chan *Client, 64),
+			unregisterCh: make(chan *Client, 64),
+			broadcastCh:  make(chan *BroadcastMsg, 2048),
+			resumeCh:     make(chan *resumeRequest, 64),
+			expireCh:     make(chan *Client, 64),
+			controlCh:    make(chan func(), 64),
+			clusterCh:    make(chan *ClusterEvent, 2048),
+		}
+	}
+	return h
 }
 
+// Run starts one event loop per shard and blocks until ctx is cancelled and
+// every shard has stopped.
 func (h *Hub) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, s := range h.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.runShard(ctx, s)
+		}()
+	}
+	wg.Wait()
+	h.closeAll()
+}
+
+func (h *Hub) runShard(ctx context.Context, s *hubShard) {
 	ticker := time.NewTicker(60 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
-			h.closeAll()
 			return
 
-		case client := <-h.registerCh:
+		case client := <-s.registerCh:
 			h.addClient(client)
 
-		case client := <-h.unregisterCh:
+		case client := <-s.unregisterCh:
 			h.removeClient(client)
 
-		case msg := <-h.broadcastCh:
+		case msg := <-s.broadcastCh:
 			h.broadcast(msg)
 
+		case req := <-s.resumeCh:
+			h.resumeClient(req)
+
+		case client := <-s.expireCh:
+			h.expire(client)
+
+		case fn := <-s.controlCh:
+			fn()
+
+		case ev := <-s.clusterCh:
+			h.applyClusterEvent(s.index, ev)
+
 		case <-ticker.C:
-			h.cleanupIdleRooms()
+			h.cleanupIdleRooms(s.index)
 		}
 	}
 }
 
+// shardIndex maps a room ID to the shard that owns it.
+func (h *Hub) shardIndex(roomID string) int {
+	f := fnv.New32a()
+	_, _ = f.Write([]byte(roomID))
+	return int(f.Sum32() % uint32(len(h.shards)))
+}
+
+func (h *Hub) shardFor(roomID string) *hubShard {
+	return h.shards[h.shardIndex(roomID)]
+}
+
+// onShard runs fn on the event loop that owns roomID and waits for it, so fn
+// is serialised with the room's joins, leaves and messages.
+func (h *Hub) onShard(roomID string, fn func()) {
+	done := make(chan struct{})
+	h.shardFor(roomID).controlCh <- func() {
+		defer close(done)
+		fn()
+	}
+	<-done
+}
+
 func (h *Hub) Register(c *Client) {
-	h.registerCh <- c
+	h.shardFor(c.roomID).registerCh <- c
 }
 
 func (h *Hub) Unregister(c *Client) {
-	h.unregisterCh <- c
+	h.shardFor(c.roomID).unregisterCh <- c
 }
 
 func (h *Hub) Broadcast(msg *BroadcastMsg) {
-	h.broadcastCh <- msg
+	h.shardFor(msg.RoomID).broadcastCh <- msg
 }
 
-func (h *Hub) RegisterHostKey(roomID string, pubKey []byte) {
+// RegisterHostKey pins pubKey as the host key for roomID. Registering the
+// already-pinned key again is a no-op; any other key is rejected with
+// ErrHostKeyConflict so a client that learns a room ID cannot take it over.
+func (h *Hub) RegisterHostKey(roomID string, pubKey []byte) error {
 	h.mu.Lock()
-	defer h.mu.Unlock()
-	key := make([]byte, len(pubKey))
-	copy(key, pubKey)
-	h.hostKeys[roomID] = key
+	if hk, ok := h.hostKeys[roomID]; ok {
+		h.mu.Unlock()
+		if !bytes.Equal(hk.key, pubKey) {
+			return ErrHostKeyConflict
+		}
+		return nil
+	}
+	hk := &hostKey{key: bytes.Clone(pubKey), pinnedAt: time.Now()}
+	h.hostKeys[roomID] = hk
+	h.mu.Unlock()
+
+	h.publish(&ClusterEvent{Type: clusterHostKey, RoomID: roomID, Key: hk.key, PinnedAt: hk.pinnedAt.UnixNano()})
+	return nil
+}
+
+// RotateHostKey replaces the pinned host key for roomID with newKey. sig must
+// be the pinned key's signature over HostKeyRotationMessage(roomID, newKey).
+// If no key is pinned yet, newKey is simply registered.
+func (h *Hub) RotateHostKey(roomID string, newKey, sig []byte) error {
+	h.mu.Lock()
+	if hk, ok := h.hostKeys[roomID]; ok && !bytes.Equal(hk.key, newKey) {
+		if len(hk.key) != ed25519.PublicKeySize ||
+			!ed25519.Verify(hk.key, HostKeyRotationMessage(roomID, newKey), sig) {
+			h.mu.Unlock()
+			return ErrInvalidRotation
+		}
+		log.Printf("room %s host key rotated", roomID)
+	}
+	hk := &hostKey{key: bytes.Clone(newKey), pinnedAt: time.Now()}
+	h.hostKeys[roomID] = hk
+	h.mu.Unlock()
+
+	h.publish(&ClusterEvent{Type: clusterHostRotate, RoomID: roomID, Key: hk.key, PinnedAt: hk.pinnedAt.UnixNano()})
+	return nil
 }
 
 func (h *Hub) GetHostKey(roomID string) []byte {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	return h.hostKeys[roomID]
+	if hk, ok := h.hostKeys[roomID]; ok {
+		return hk.key
+	}
+	return nil
 }
 
 func (h *Hub) RoomCount() int {
@@ -94,13 +256,26 @@ func (h *Hub) RoomCount() int {
 	return len(h.rooms)
 }
 
+// ClientCount returns the number of connections to roomID across the
+// cluster, so room limits hold no matter which node a peer lands on.
 func (h *Hub) ClientCount(roomID string) int {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	n := h.remoteCount(roomID)
 	if room, ok := h.rooms[roomID]; ok {
-		return room.ClientCount()
+		n += room.ClientCount()
 	}
-	return 0
+	return n
+}
+
+func (h *Hub) TotalClientCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	total := 0
+	for _, room := range h.rooms {
+		total += room.ClientCount()
+	}
+	return total
 }
 
 func (h *Hub) addClient(c *Client) {
@@ -108,43 +283,127 @@ func (h *Hub) addClient(c *Client) {
 	room, ok := h.rooms[c.roomID]
 	if !ok {
 		room = NewRoom(c.roomID)
+		room.slowConsumer = h.slowConsumerFor(c.roomID)
 		h.rooms[c.roomID] = room
 	}
+	c.muted.Store(h.muted(c.roomID, c.tokenPeerID))
 	h.mu.Unlock()
 
+	// The roster is taken before the newcomer is added so it only lists the
+	// peers that were already present.
+	c.trySend(newEnvelope("session:roster", relayPeerID, &Roster{Peers: h.roster(room)}))
 	room.Add(c)
+	if c.role == "host" {
+		h.hostArrived(c.roomID)
+		h.replayLobby(c)
+	}
+	info := c.info()
+	room.Broadcast(c.connID, newEnvelope("session:join", c.peerID, info))
+	h.publish(&ClusterEvent{Type: clusterJoin, RoomID: c.roomID, ConnID: c.connID, Peer: &info})
 	log.Printf("peer %s (conn=%s) joined room %s (role=%s)", c.peerID, c.connID[:8], c.roomID, c.role)
 
-	go c.ReadPump()
-	go c.WritePump()
+	if h.cfg.ResumeGrace > 0 {
+		c.trySend(newEnvelope("session:resume_token", relayPeerID, &ResumeInfo{
+			Token:   h.issueResumeToken(c),
+			GraceMs: h.cfg.ResumeGrace.Milliseconds(),
+		}))
+	}
+
+	c.start()
+}
+
+// roster lists the peers in room on this node and on the rest of the
+// cluster, one entry per peer ID.
+func (h *Hub) roster(room *Room) []PeerInfo {
+	peers := room.Peers()
+	seen := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		seen[p.PeerID] = true
+	}
+	for _, p := range h.remotePeers(room.id) {
+		if !seen[p.PeerID] {
+			seen[p.PeerID] = true
+			peers = append(peers, p)
+		}
+	}
+	return peers
 }
 
 func (h *Hub) removeClient(c *Client) {
+	if h.leaveLobby(c, "left") {
+		return
+	}
+
+	h.mu.RLock()
+	room, ok := h.rooms[c.roomID]
+	h.mu.RUnlock()
+
+	// A client that was resumed has been replaced in the room; the old
+	// connection's unregistration is stale.
+	if !ok || room.Get(c.connID) != c {
+		return
+	}
+
+	c.mu.Lock()
+	resumable, detached := c.resumable, c.detached
+	c.mu.Unlock()
+	if resumable && h.cfg.ResumeGrace > 0 && c.resumeToken != "" {
+		if !detached {
+			h.detach(c)
+			return
+		}
+	}
+
+	h.dropClient(c)
+}
+
+// dropClient removes c from its room for good and notifies the remaining
+// peers.
+func (h *Hub) dropClient(c *Client) {
 	h.mu.Lock()
+	delete(h.resumeTokens, c.resumeToken)
 	room, ok := h.rooms[c.roomID]
+	empty := false
 	if ok {
 		room.Remove(c)
 		if room.ClientCount() == 0 {
 			delete(h.rooms, c.roomID)
-			delete(h.hostKeys, c.roomID)
+			// Other nodes still serving the room keep the pin alive.
+			if h.remoteCount(c.roomID) == 0 {
+				h.forgetRoom(c.roomID)
+			}
+			empty = true
 			log.Printf("room %s destroyed (no clients)", c.roomID)
-		} else {
-			// Notify remaining peers that this client disconnected.
-			// Generate a synthetic session:leave envelope so clients
-			// can remove the peer from their room.
-			notification := []byte(fmt.Sprintf(
-				`{"id":"","type":"session:leave","from":"%s","ts":%d,"nonce":0,"payload":null,"sig":null}`,
-				c.peerID, time.Now().UnixMilli(),
-			))
-			room.Broadcast(c.connID, notification)
 		}
 	}
 	h.mu.Unlock()
 
+	if ok {
+		h.publish(&ClusterEvent{Type: clusterLeave, RoomID: c.roomID, ConnID: c.connID})
+	}
+
+	// The room can only change on this shard, so it is safe to fan out the
+	// notification without holding the hub lock.
+	if ok && !empty {
+		h.leaveTransfers(room, c)
+
+		// Notify remaining peers that this client disconnected.
+		// Generate a synthetic session:leave envelope so clients
+		// can remove the peer from their room.
+		room.Broadcast(c.connID, newEnvelope("session:leave", c.peerID, nil))
+		if c.role == "host" {
+			h.hostLeft(c.roomID, c.peerID)
+		}
+	}
+
 	log.Printf("peer %s left room %s", c.peerID, c.roomID)
 }
 
 func (h *Hub) broadcast(msg *BroadcastMsg) {
+	if msg.frame != nil {
+		defer msg.frame.release()
+	}
+
 	h.mu.RLock()
 	room, ok := h.rooms[msg.RoomID]
 	h.mu.RUnlock()
@@ -153,22 +412,103 @@ func (h *Hub) broadcast(msg *BroadcastMsg) {
 		return
 	}
 
-	room.Broadcast(msg.SenderID, msg.Data)
+	if h.relayTransfer(room, msg) {
+		return
+	}
+
+	if len(msg.To) == 0 {
+		if msg.frame != nil {
+			room.broadcastFrame(msg.SenderID, msg.frame)
+		} else {
+			room.Broadcast(msg.SenderID, msg.Data)
+		}
+		if h.hasRemotePeer(msg.RoomID, nil) {
+			data := msg.Data
+			if msg.frame != nil {
+				// The backplane may hold on to data after the buffer is reused.
+				data = bytes.Clone(data)
+			}
+			h.publish(&ClusterEvent{Type: clusterMessage, RoomID: msg.RoomID, ConnID: msg.SenderID, Data: data})
+		}
+		return
+	}
+
+	missing := room.SendTo(msg.SenderID, msg.To, msg.Data)
+	if h.hasRemotePeer(msg.RoomID, msg.To) {
+		h.publish(&ClusterEvent{Type: clusterMessage, RoomID: msg.RoomID, ConnID: msg.SenderID, To: msg.To, Data: msg.Data})
+		missing = slices.DeleteFunc(missing, func(id string) bool {
+			return h.hasRemotePeer(msg.RoomID, []string{id})
+		})
+	}
+	if len(missing) > 0 {
+		if sender := room.Get(msg.SenderID); sender != nil {
+			sender.trySend(newRelayError(&RelayError{
+				Code:    "unknown_recipient",
+				Message: "recipient not in room",
+				Peers:   missing,
+			}))
+		}
+	}
 }
 
-func (h *Hub) cleanupIdleRooms() {
+// cleanupIdleRooms closes idle rooms owned by the given shard. It only
+// touches that shard's rooms so it cannot race with their joins and leaves.
+func (h *Hub) cleanupIdleRooms(shard int) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	now := time.Now()
 	for id, room := range h.rooms {
+		if h.shardIndex(id) != shard {
+			continue
+		}
 		if now.Sub(room.LastActivity()) > h.cfg.RoomIdleTimeout {
 			room.CloseAll()
 			delete(h.rooms, id)
-			delete(h.hostKeys, id)
+			if h.remoteCount(id) == 0 {
+				h.forgetRoom(id)
+			}
+			for _, c := range room.Clients() {
+				delete(h.resumeTokens, c.resumeToken)
+				h.publish(&ClusterEvent{Type: clusterLeave, RoomID: id, ConnID: c.connID})
+			}
 			log.Printf("room %s cleaned up (idle timeout)", id)
 		}
 	}
+
+	// Drop pins for rooms that never got a client (e.g. the host's upgrade
+	// failed) so a stale pin cannot lock the room ID forever.
+	for id, hk := range h.hostKeys {
+		if h.shardIndex(id) != shard {
+			continue
+		}
+		if _, ok := h.rooms[id]; !ok && h.remoteCount(id) == 0 && now.Sub(hk.pinnedAt) > h.cfg.RoomIdleTimeout {
+			h.forgetRoom(id)
+		}
+	}
+
+	// The replay caches span all rooms; one shard is enough to prune them.
+	if shard == 0 {
+		h.pruneJTIs(now)
+		h.pruneControlSeen(now)
+	}
+}
+
+// forgetRoom drops the host-owned state of a room that no longer has peers
+// anywhere: its pinned key, deny list, peer limit, moderation state and
+// lobby, whose guests are turned away. Spent single-use tokens stay in the
+// replay cache until they expire. The caller must hold h.mu.
+func (h *Hub) forgetRoom(roomID string) {
+	delete(h.hostKeys, roomID)
+	delete(h.denied, roomID)
+	delete(h.roomLimits, roomID)
+	delete(h.moderation, roomID)
+	for _, e := range h.lobbies[roomID] {
+		e.timer.Stop()
+		metrics.LobbyOutcomes.Inc("closed")
+		e.c.refuse(&rejection{"room_closed", "room closed", http.StatusGone})
+	}
+	delete(h.lobbies, roomID)
 }
 
 func (h *Hub) closeAll() {
@@ -179,5 +519,9 @@ func (h *Hub) closeAll() {
 		room.CloseAll()
 	}
 	h.rooms = make(map[string]*Room)
-	h.hostKeys = make(map[string][]byte)
+	h.hostKeys = make(map[string]*hostKey)
+	h.resumeTokens = make(map[string]*Client)
+	h.denied = make(map[string]*denyList)
+	h.roomLimits = make(map[string]int)
+	h.moderation = make(map[string]*roomModeration)
 }
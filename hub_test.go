@@ -1,7 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -13,6 +21,11 @@ func testConfig() *Config {
 		MaxMessageSize:    1048576,
 		RoomIdleTimeout:   1 * time.Hour,
 		RateLimitPerIP:    100,
+		AllowQueryToken:   true,
+		LobbyTimeout:      time.Minute,
+		LobbyMaxPending:   20,
+		TransferChunkSize: 256 << 10,
+		TransferWindow:    16,
 	}
 }
 
@@ -76,3 +89,201 @@ func TestHub_RunAndShutdown(t *testing.T) {
 		t.Fatal("hub.Run did not return after cancel")
 	}
 }
+
+func TestHub_RegisterHostKey_Pinned(t *testing.T) {
+	hub := NewHub(testConfig())
+
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 32)
+
+	if err := hub.RegisterHostKey("room-1", key1); err != nil {
+		t.Fatalf("first registration: %v", err)
+	}
+	if err := hub.RegisterHostKey("room-1", key1); err != nil {
+		t.Errorf("re-registration with same key: %v", err)
+	}
+	if err := hub.RegisterHostKey("room-1", key2); !errors.Is(err, ErrHostKeyConflict) {
+		t.Errorf("expected ErrHostKeyConflict, got %v", err)
+	}
+	if got := hub.GetHostKey("room-1"); !bytes.Equal(got, key1) {
+		t.Error("pinned key was overwritten")
+	}
+}
+
+func TestHub_RotateHostKey(t *testing.T) {
+	hub := NewHub(testConfig())
+
+	oldPub, oldPriv, _ := ed25519.GenerateKey(rand.Reader)
+	newPub, newPriv, _ := ed25519.GenerateKey(rand.Reader)
+	_ = hub.RegisterHostKey("room-1", oldPub)
+
+	// A rotation signed by the new key itself must be rejected.
+	forged, _ := base64.RawURLEncoding.DecodeString(SignHostKeyRotation(newPriv, "room-1", newPub))
+	if err := hub.RotateHostKey("room-1", newPub, forged); !errors.Is(err, ErrInvalidRotation) {
+		t.Fatalf("expected ErrInvalidRotation, got %v", err)
+	}
+
+	// A rotation for a different room must be rejected.
+	otherRoom, _ := base64.RawURLEncoding.DecodeString(SignHostKeyRotation(oldPriv, "room-2", newPub))
+	if err := hub.RotateHostKey("room-1", newPub, otherRoom); !errors.Is(err, ErrInvalidRotation) {
+		t.Fatalf("expected ErrInvalidRotation for wrong room, got %v", err)
+	}
+
+	sig, _ := base64.RawURLEncoding.DecodeString(SignHostKeyRotation(oldPriv, "room-1", newPub))
+	if err := hub.RotateHostKey("room-1", newPub, sig); err != nil {
+		t.Fatalf("valid rotation: %v", err)
+	}
+	if got := hub.GetHostKey("room-1"); !bytes.Equal(got, newPub) {
+		t.Error("host key was not rotated")
+	}
+}
+
+func TestHub_ShardIndex(t *testing.T) {
+	cfg := testConfig()
+	cfg.HubShards = 4
+	hub := NewHub(cfg)
+
+	if len(hub.shards) != 4 {
+		t.Fatalf("shards = %d, want 4", len(hub.shards))
+	}
+
+	seen := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("room-%d", i)
+		idx := hub.shardIndex(id)
+		if idx != hub.shardIndex(id) {
+			t.Fatalf("shardIndex(%q) is not stable", id)
+		}
+		seen[idx] = true
+	}
+	if len(seen) != 4 {
+		t.Errorf("100 rooms landed on %d of 4 shards", len(seen))
+	}
+}
+
+func TestHub_BroadcastAcrossShards(t *testing.T) {
+	cfg := testConfig()
+	cfg.HubShards = 4
+	hub := NewHub(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+
+	receivers := make(map[string]*Client)
+	for i := 0; i < 8; i++ {
+		id := fmt.Sprintf("room-%d", i)
+		room := NewRoom(id)
+		rcv := &Client{peerID: "rcv", connID: "rcv-" + id, send: make(chan []byte, 10)}
+		room.Add(rcv)
+		hub.mu.Lock()
+		hub.rooms[id] = room
+		hub.mu.Unlock()
+		receivers[id] = rcv
+	}
+
+	for id := range receivers {
+		hub.Broadcast(&BroadcastMsg{RoomID: id, SenderID: "sender", Data: []byte(id)})
+	}
+
+	for id, rcv := range receivers {
+		select {
+		case msg := <-rcv.send:
+			if string(msg) != id {
+				t.Errorf("room %s received %q", id, msg)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("room %s did not receive its message", id)
+		}
+	}
+}
+
+// BenchmarkHub_Broadcast measures relay throughput across many rooms. Run
+// with -cpu 1,2,4,8 to see it scale with the number of hub shards.
+func BenchmarkHub_Broadcast(b *testing.B) {
+	const numRooms = 256
+
+	cfg := testConfig()
+	hub := NewHub(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomIDs := make([]string, numRooms)
+	for i := range roomIDs {
+		id := fmt.Sprintf("bench-room-%d", i)
+		room := NewRoom(id)
+		for j := 0; j < 4; j++ {
+			c := &Client{peerID: "p", connID: fmt.Sprintf("%s-%d", id, j), send: make(chan []byte, 1024)}
+			room.Add(c)
+			go func() {
+				for {
+					select {
+					case <-c.send:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+		hub.rooms[id] = room
+		roomIDs[i] = id
+	}
+	go hub.Run(ctx)
+
+	payload := []byte(`{"type":"bench","payload":"xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"}`)
+	var next atomic.Uint64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			id := roomIDs[next.Add(1)%numRooms]
+			hub.Broadcast(&BroadcastMsg{RoomID: id, SenderID: id + "-0", Data: payload})
+		}
+	})
+}
+
+func TestHub_Broadcast_UnknownRecipient(t *testing.T) {
+	hub := NewHub(testConfig())
+
+	room := NewRoom("room-1")
+	sender := &Client{peerID: "peer-1", connID: "conn-1", send: make(chan []byte, 10)}
+	other := &Client{peerID: "peer-2", connID: "conn-2", send: make(chan []byte, 10)}
+	room.Add(sender)
+	room.Add(other)
+	hub.rooms["room-1"] = room
+
+	hub.broadcast(&BroadcastMsg{RoomID: "room-1", SenderID: "conn-1", To: []string{"ghost"}, Data: []byte("x")})
+
+	if len(other.send) != 0 {
+		t.Error("unicast to an unknown peer must not fall back to broadcast")
+	}
+	select {
+	case msg := <-sender.send:
+		if !strings.Contains(string(msg), `"code":"unknown_recipient"`) || !strings.Contains(string(msg), `"ghost"`) {
+			t.Errorf("unexpected error envelope %s", msg)
+		}
+	default:
+		t.Fatal("sender did not receive a relay error")
+	}
+}
+
+func TestHub_CleanupIdleRooms_ForgetsResumeTokens(t *testing.T) {
+	cfg := testConfig()
+	cfg.RoomIdleTimeout = time.Millisecond
+	hub := NewHub(cfg)
+	room := NewRoom("room-1")
+	c := &Client{roomID: "room-1", peerID: "guest-1", tokenPeerID: "guest-1", connID: "conn-1", send: make(chan []byte, 1)}
+	room.Add(c)
+	hub.rooms["room-1"] = room
+	token := hub.issueResumeToken(c)
+
+	time.Sleep(5 * time.Millisecond)
+	hub.cleanupIdleRooms(hub.shardIndex("room-1"))
+	if hub.RoomCount() != 0 {
+		t.Fatal("idle room was not cleaned up")
+	}
+	if hub.CanResume(token, "room-1", "guest-1") {
+		t.Error("resume token outlived its idle room")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// lobbyEntry is a guest waiting for the host to let it into the room. Its
+// pumps run so pings and disconnects are handled, but its messages are
+// dropped until it is approved.
+type lobbyEntry struct {
+	c     *Client
+	timer *time.Timer
+}
+
+// LobbyGuest is the payload of lobby:request and lobby:left. Guests sharing
+// an invite share a peer ID, so the host answers a request by its ConnID.
+type LobbyGuest struct {
+	PeerInfo
+	ConnID string `json:"conn_id"`
+}
+
+func (c *Client) lobbyGuest() *LobbyGuest {
+	return &LobbyGuest{PeerInfo: c.info(), ConnID: c.connID}
+}
+
+func init() {
+	controlHandlers["relay:approve"] = lobbyHandler("relay:approve")
+	controlHandlers["relay:deny"] = lobbyHandler("relay:deny")
+}
+
+// lobbyHandler returns the control handler that lets a waiting connection in
+// or turns it away. On a cluster the guest may be waiting on another node, so
+// only a standalone relay can tell that nobody matched.
+func lobbyHandler(typ string) controlHandler {
+	return func(h *Hub, host *Client, payload json.RawMessage) *RelayError {
+		var cmd ModerationCommand
+		if err := json.Unmarshal(payload, &cmd); err != nil || cmd.ConnID == "" {
+			return &RelayError{Code: "invalid_control", Message: typ + " needs the conn_id from lobby:request"}
+		}
+		if !h.settleLobby(host.roomID, typ, &cmd) && h.backplane == nil {
+			rerr := &RelayError{Code: "unknown_peer", Message: "no such guest waiting in lobby"}
+			if cmd.Peer != "" {
+				rerr.Peers = []string{cmd.Peer}
+			}
+			return rerr
+		}
+		h.publish(&ClusterEvent{Type: clusterModerate, RoomID: host.roomID, Control: typ, Moderation: &cmd})
+		return nil
+	}
+}
+
+// SetLobby makes guests of roomID wait for the host's approval. A lobby,
+// once requested by a host token, lasts as long as the room.
+func (h *Hub) SetLobby(roomID string) {
+	h.mu.Lock()
+	m := h.moderationFor(roomID)
+	was := m.lobby
+	m.lobby = true
+	h.mu.Unlock()
+
+	if !was {
+		h.publish(&ClusterEvent{Type: clusterModerate, RoomID: roomID, Control: "lobby", Moderation: &ModerationCommand{}})
+	}
+}
+
+// Lobby reports whether guests of roomID wait for approval.
+func (h *Hub) Lobby(roomID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	m, ok := h.moderation[roomID]
+	return ok && m.lobby
+}
+
+// Wait puts an admitted guest in roomID's lobby instead of the room.
+func (h *Hub) Wait(c *Client) {
+	h.shardFor(c.roomID).controlCh <- func() {
+		h.enqueue(c)
+	}
+}
+
+func (h *Hub) enqueue(c *Client) {
+	c.waiting.Store(true)
+	c.start()
+
+	h.mu.Lock()
+	pending, ok := h.lobbies[c.roomID]
+	if !ok {
+		pending = make(map[string]*lobbyEntry)
+		h.lobbies[c.roomID] = pending
+	}
+	if len(pending) >= h.cfg.LobbyMaxPending {
+		h.mu.Unlock()
+		metrics.LobbyOutcomes.Inc("full")
+		c.refuse(&rejection{"lobby_full", "too many guests waiting", http.StatusServiceUnavailable})
+		return
+	}
+	pending[c.connID] = &lobbyEntry{
+		c: c,
+		timer: time.AfterFunc(h.cfg.LobbyTimeout, func() {
+			h.shardFor(c.roomID).controlCh <- func() {
+				if h.leaveLobby(c, "timeout") {
+					c.refuse(&rejection{"lobby_timeout", "host did not answer", http.StatusForbidden})
+				}
+			}
+		}),
+	}
+	h.mu.Unlock()
+
+	log.Printf("peer %s (conn=%s) waiting in lobby of room %s", c.peerID, c.connID[:8], c.roomID)
+	c.trySend(newEnvelope("lobby:waiting", relayPeerID, nil))
+	h.toHosts(c.roomID, newEnvelope("lobby:request", c.peerID, c.lobbyGuest()))
+}
+
+// leaveLobby removes c from its room's lobby, telling the hosts unless it was
+// let in. It reports whether c was waiting. It must run on the room's shard.
+func (h *Hub) leaveLobby(c *Client, outcome string) bool {
+	h.mu.Lock()
+	e, ok := h.lobbies[c.roomID][c.connID]
+	if ok {
+		e.timer.Stop()
+		delete(h.lobbies[c.roomID], c.connID)
+		if len(h.lobbies[c.roomID]) == 0 {
+			delete(h.lobbies, c.roomID)
+		}
+	}
+	h.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	metrics.LobbyOutcomes.Inc(outcome)
+	if outcome != "approved" {
+		log.Printf("peer %s (conn=%s) left lobby of room %s: %s", c.peerID, c.connID[:8], c.roomID, outcome)
+		h.toHosts(c.roomID, newEnvelope("lobby:left", c.peerID, c.lobbyGuest()))
+	}
+	return true
+}
+
+// settleLobby approves or denies the connection waiting in roomID with the
+// command's conn ID, and reports whether there was one. A peer ID, if the
+// command names one, must match as well. It runs on the room's shard.
+func (h *Hub) settleLobby(roomID, typ string, cmd *ModerationCommand) bool {
+	h.mu.RLock()
+	e, ok := h.lobbies[roomID][cmd.ConnID]
+	h.mu.RUnlock()
+	if !ok || (cmd.Peer != "" && e.c.tokenPeerID != cmd.Peer) {
+		return false
+	}
+
+	c := e.c
+	switch {
+	case typ == "relay:deny":
+		h.leaveLobby(c, "denied")
+		c.refuse(&rejection{"lobby_denied", "host declined", http.StatusForbidden})
+	case h.ClientCount(roomID) >= h.RoomLimit(roomID):
+		// The room filled up while the guest waited.
+		h.leaveLobby(c, "room_full")
+		c.refuse(&rejection{"room_full", "room full", http.StatusServiceUnavailable})
+	default:
+		h.leaveLobby(c, "approved")
+		c.waiting.Store(false)
+		h.addClient(c)
+	}
+	return true
+}
+
+// replayLobby sends a host that just joined the requests still waiting.
+func (h *Hub) replayLobby(host *Client) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, e := range h.lobbies[host.roomID] {
+		host.trySend(newEnvelope("lobby:request", e.c.peerID, e.c.lobbyGuest()))
+	}
+}
+
+// toHosts sends data to the hosts of roomID, wherever they are connected.
+func (h *Hub) toHosts(roomID string, data []byte) {
+	h.mu.RLock()
+	room := h.rooms[roomID]
+	var remote []string
+	for _, p := range h.remote[roomID] {
+		if p.info.Role == "host" {
+			remote = append(remote, p.info.PeerID)
+		}
+	}
+	h.mu.RUnlock()
+
+	if room != nil {
+		for _, c := range room.Clients() {
+			if c.role == "host" {
+				c.trySend(data)
+			}
+		}
+	}
+	if len(remote) > 0 {
+		h.publish(&ClusterEvent{Type: clusterMessage, RoomID: roomID, To: remote, Data: data})
+	}
+}
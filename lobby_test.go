@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func joinLobbyHost(t *testing.T, tr *testRelay, roomID string) (*websocket.Conn, []byte) {
+	t.Helper()
+	pub, priv, _ := hostToken(t, roomID)
+	hostJWT := capabilityToken(priv, roomID, "host-1", func(c *Claims) {
+		c.Role = "host"
+		c.Lobby = true
+	})
+	host := tr.dial(t, url.Values{"room": {roomID}, "token": {hostJWT}, "pubkey": {base64.RawURLEncoding.EncodeToString(pub)}})
+	readEnvelope(t, host, "session:roster")
+	return host, priv
+}
+
+// expectClose reads until conn is closed and checks the close code and
+// reason.
+func expectClose(t *testing.T, conn *websocket.Conn, code int, reason string) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != code || ce.Text != reason {
+				t.Errorf("close = %v, want %d %q", err, code, reason)
+			}
+			return
+		}
+	}
+}
+
+// lobbyConnID returns the conn_id of a lobby:request or lobby:left envelope.
+func lobbyConnID(env map[string]any) string {
+	id, _ := env["payload"].(map[string]any)["conn_id"].(string)
+	return id
+}
+
+func TestLobby_Approve(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	host, priv := joinLobbyHost(t, tr, "room-1")
+
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	readEnvelope(t, guest, "lobby:waiting")
+	req := readEnvelope(t, host, "lobby:request")
+	if req["from"] != "guest-1" {
+		t.Errorf("lobby:request from %v", req["from"])
+	}
+	if got := tr.hub.ClientCount("room-1"); got != 1 {
+		t.Errorf("ClientCount = %d while guest waits, want 1", got)
+	}
+
+	_ = host.WriteMessage(websocket.BinaryMessage,
+		SignControl(priv, "room-1", "relay:approve", 1, &ModerationCommand{ConnID: "nobody"}))
+	if e := readEnvelope(t, host, "relay:error"); e["payload"].(map[string]any)["code"] != "unknown_peer" {
+		t.Errorf("approve unknown peer error = %v", e["payload"])
+	}
+
+	_ = host.WriteMessage(websocket.BinaryMessage,
+		SignControl(priv, "room-1", "relay:approve", 2, &ModerationCommand{ConnID: lobbyConnID(req)}))
+	readEnvelope(t, guest, "session:roster")
+	readEnvelope(t, host, "session:join")
+
+	_ = guest.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"chat","from":"guest-1"}`))
+	readEnvelope(t, host, "chat")
+}
+
+func TestLobby_Deny(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	host, priv := joinLobbyHost(t, tr, "room-1")
+
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	readEnvelope(t, guest, "lobby:waiting")
+	req := readEnvelope(t, host, "lobby:request")
+
+	// Messages sent while waiting never reach the room.
+	_ = guest.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"chat","from":"guest-1"}`))
+
+	_ = host.WriteMessage(websocket.BinaryMessage,
+		SignControl(priv, "room-1", "relay:deny", 1, &ModerationCommand{ConnID: lobbyConnID(req)}))
+	if e := readEnvelope(t, guest, "relay:error"); e["payload"].(map[string]any)["code"] != "lobby_denied" {
+		t.Errorf("deny error = %v", e["payload"])
+	}
+	expectClose(t, guest, websocket.ClosePolicyViolation, "lobby_denied")
+	readEnvelope(t, host, "lobby:left")
+}
+
+func TestLobby_TimeoutAndCap(t *testing.T) {
+	cfg := testConfig()
+	cfg.LobbyTimeout = 300 * time.Millisecond
+	cfg.LobbyMaxPending = 1
+	tr := newTestRelay(t, cfg)
+	_, priv := joinLobbyHost(t, tr, "room-1")
+
+	before := metrics.LobbyOutcomes.Value("timeout")
+	first := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	readEnvelope(t, first, "lobby:waiting")
+
+	second := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-2")}})
+	expectClose(t, second, websocket.CloseTryAgainLater, "lobby_full")
+
+	expectClose(t, first, websocket.ClosePolicyViolation, "lobby_timeout")
+	if got := metrics.LobbyOutcomes.Value("timeout") - before; got != 1 {
+		t.Errorf("timeout outcomes = %d, want 1", got)
+	}
+}
+
+func TestLobby_BogusResumeWaits(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	host, priv := joinLobbyHost(t, tr, "room-1")
+
+	// A resume token that resumes nothing does not skip the lobby.
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}, "resume": {"bogus"}})
+	readEnvelope(t, guest, "lobby:waiting")
+	readEnvelope(t, host, "lobby:request")
+	if got := tr.hub.ClientCount("room-1"); got != 1 {
+		t.Errorf("ClientCount = %d after bogus resume, want 1", got)
+	}
+}
+
+func TestLobby_ForgottenWithRoom(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	host, priv := joinLobbyHost(t, tr, "room-1")
+
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	readEnvelope(t, guest, "lobby:waiting")
+	readEnvelope(t, host, "lobby:request")
+
+	// The room goes with its last peer, and its lobby with it.
+	host.Close()
+	expectClose(t, guest, websocket.ClosePolicyViolation, "room_closed")
+	tr.hub.mu.RLock()
+	defer tr.hub.mu.RUnlock()
+	if len(tr.hub.lobbies) != 0 {
+		t.Errorf("lobbies = %v after the room was forgotten", tr.hub.lobbies)
+	}
+}
+
+func TestLobby_SharedInviteApprovesOneConnection(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	host, priv := joinLobbyHost(t, tr, "room-1")
+
+	// Two guests arrive on one invite, so they share a peer ID.
+	invite := guestToken(priv, "room-1", "guest-1")
+	first := tr.dial(t, url.Values{"room": {"room-1"}, "token": {invite}})
+	readEnvelope(t, first, "lobby:waiting")
+	req := readEnvelope(t, host, "lobby:request")
+	second := tr.dial(t, url.Values{"room": {"room-1"}, "token": {invite}})
+	readEnvelope(t, second, "lobby:waiting")
+	readEnvelope(t, host, "lobby:request")
+
+	_ = host.WriteMessage(websocket.BinaryMessage,
+		SignControl(priv, "room-1", "relay:approve", 1, &ModerationCommand{Peer: "guest-1", ConnID: lobbyConnID(req)}))
+	readEnvelope(t, first, "session:roster")
+	if got := tr.hub.ClientCount("room-1"); got != 2 {
+		t.Errorf("ClientCount = %d, want the host and the approved connection only", got)
+	}
+	expectSilence(t, second)
+}
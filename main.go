@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -14,11 +15,50 @@ func main() {
 	hub := NewHub(cfg)
 	srv := NewServer(cfg, hub)
 
+	var mesh *TCPMesh
+	if cfg.ClusterAddr != "" {
+		if cfg.ClusterSecret == "" {
+			log.Fatal("RELAY_CLUSTER_ADDR requires RELAY_CLUSTER_SECRET")
+		}
+		var err error
+		mesh, err = NewTCPMesh(cfg.NodeID, cfg.ClusterAddr, cfg.ClusterPeers, cfg.ClusterSecret)
+		if err != nil {
+			log.Fatalf("cluster mesh: %v", err)
+		}
+		hub.SetBackplane(mesh)
+		log.Printf("cluster node %s listening on %s (%d peers)", cfg.NodeID, cfg.ClusterAddr, len(cfg.ClusterPeers))
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	go hub.Run(ctx)
 
+	var metricsSrv *http.Server
+	if cfg.MetricsAddr != "" {
+		metricsSrv = NewMetricsServer(cfg.MetricsAddr, hub)
+		go func() {
+			log.Printf("metrics listening on %s", cfg.MetricsAddr)
+			if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("metrics server error: %v", err)
+			}
+		}()
+	}
+
+	var adminSrv *http.Server
+	if cfg.AdminAddr != "" {
+		if cfg.AdminToken == "" {
+			log.Fatal("RELAY_ADMIN_ADDR requires RELAY_ADMIN_TOKEN")
+		}
+		adminSrv = NewAdminServer(cfg.AdminAddr, cfg.AdminToken, hub)
+		go func() {
+			log.Printf("admin API listening on %s", cfg.AdminAddr)
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("admin server error: %v", err)
+			}
+		}()
+	}
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
@@ -26,6 +66,15 @@ func main() {
 		<-sigCh
 		log.Println("shutting down...")
 		cancel()
+		if metricsSrv != nil {
+			_ = metricsSrv.Close()
+		}
+		if adminSrv != nil {
+			_ = adminSrv.Close()
+		}
+		if mesh != nil {
+			_ = mesh.Close()
+		}
 		srv.Shutdown()
 	}()
 
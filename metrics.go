@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics is the process-wide metrics registry. Counters are updated from
+// the hot path (Room.Broadcast, handleWS) without taking any hub locks.
+var metrics = NewMetrics()
+
+// Metrics holds the relay's Prometheus counters. Gauges that describe hub
+// state (rooms, clients) are computed at scrape time instead of being kept
+// in sync on every join/leave.
+type Metrics struct {
+	MessagesRelayed      *CounterVec
+	BytesRelayed         *CounterVec
+	SendsDropped         *CounterVec
+	OversizeMessages     *CounterVec
+	RateLimited          *CounterVec
+	Resumptions          *CounterVec
+	HandshakeRejections  *CounterVec
+	ClusterEvents        *CounterVec
+	ClusterEventsDropped *CounterVec
+	PlacementRedirects   *CounterVec
+	ControlMessages      *CounterVec
+	AuthMethods          *CounterVec
+	CapabilityViolations *CounterVec
+	LobbyOutcomes        *CounterVec
+	SlowConsumerActions  *CounterVec
+	TransferOutcomes     *CounterVec
+	Framing              *CounterVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		MessagesRelayed:      NewCounterVec("relay_messages_relayed_total", "Messages delivered to peers.", "kind"),
+		BytesRelayed:         NewCounterVec("relay_bytes_relayed_total", "Bytes delivered to peers.", "kind"),
+		SendsDropped:         NewCounterVec("relay_sends_dropped_total", "Messages dropped because a peer's send buffer was full.", "kind"),
+		OversizeMessages:     NewCounterVec("relay_oversize_messages_total", "Messages that exceeded the size limit, by kind and action taken.", "kind", "action"),
+		RateLimited:          NewCounterVec("relay_rate_limited_messages_total", "Messages over a client's per-connection budget, by kind and action taken.", "kind", "action"),
+		Resumptions:          NewCounterVec("relay_resumptions_total", "Session resumption outcomes (resumed, expired, fallback, refused).", "result"),
+		HandshakeRejections:  NewCounterVec("relay_handshake_rejections_total", "WebSocket handshakes rejected before upgrade.", "reason"),
+		ClusterEvents:        NewCounterVec("relay_cluster_events_total", "Backplane events by type and direction (in, out).", "type", "direction"),
+		ClusterEventsDropped: NewCounterVec("relay_cluster_events_dropped_total", "Backplane events dropped because a node's queue was full or its link was down.", "node"),
+		AuthMethods:          NewCounterVec("relay_auth_method_total", "Accepted connections by how the token was sent (header, subprotocol, query).", "method"),
+		ControlMessages:      NewCounterVec("relay_control_messages_total", "Host control messages by type and result (ok or error code).", "type", "result"),
+		PlacementRedirects:   NewCounterVec("relay_placement_redirects_total", "Connections redirected to the node that owns their room, by mode (http, close).", "mode"),
+		SlowConsumerActions:  NewCounterVec("relay_slow_consumer_actions_total", "Actions taken on peers whose send queue was full, beyond dropping (disconnect, voice_evicted).", "action"),
+		LobbyOutcomes:        NewCounterVec("relay_lobby_outcomes_total", "Guests leaving a room's lobby, by outcome (approved, denied, timeout, full, left, room_full, closed).", "outcome"),
+		Framing:              NewCounterVec("relay_framing_total", "Accepted connections by the framing they negotiated (newline, records).", "mode"),
+		TransferOutcomes:     NewCounterVec("relay_transfers_total", "Chunked transfers by outcome (completed, aborted, out_of_order, no_credit, sender_left).", "outcome"),
+		CapabilityViolations: NewCounterVec("relay_capability_violations_total", "Messages dropped because the sender's token did not allow them, by claim.", "capability"),
+	}
+}
+
+// packetKind returns the metrics label for a relayed message.
+func packetKind(data []byte) string {
+	if isVoicePacket(data) {
+		return "voice"
+	}
+	if isTransferChunk(data) {
+		return "chunk"
+	}
+	return "data"
+}
+
+// CounterVec is a minimal Prometheus counter with labels. It exists so the
+// relay can export metrics without pulling in the client_golang dependency.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.RWMutex
+	values map[string]*atomic.Uint64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*atomic.Uint64),
+	}
+}
+
+// Add increments the counter identified by labelValues, which must be given
+// in the same order as the label names passed to NewCounterVec.
+func (v *CounterVec) Add(n uint64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+
+	v.mu.RLock()
+	c, ok := v.values[key]
+	v.mu.RUnlock()
+
+	if !ok {
+		v.mu.Lock()
+		if c, ok = v.values[key]; !ok {
+			c = new(atomic.Uint64)
+			v.values[key] = c
+		}
+		v.mu.Unlock()
+	}
+	c.Add(n)
+}
+
+func (v *CounterVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Value returns the current value for labelValues (0 if never incremented).
+func (v *CounterVec) Value(labelValues ...string) uint64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if c, ok := v.values[strings.Join(labelValues, "\x00")]; ok {
+		return c.Load()
+	}
+	return 0
+}
+
+func (v *CounterVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, formatLabels(v.labels, strings.Split(k, "\x00")), v.values[k].Load())
+	}
+	v.mu.RUnlock()
+}
+
+func writeGauge(w io.Writer, name, help string, value int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		val := ""
+		if i < len(values) {
+			val = values[i]
+		}
+		fmt.Fprintf(&b, "%s=%q", name, val)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// WriteTo renders all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer, hub *Hub) {
+	writeGauge(w, "relay_rooms", "Rooms with at least one connected client.", hub.RoomCount())
+	writeGauge(w, "relay_clients", "Connected clients across all rooms.", hub.TotalClientCount())
+	m.MessagesRelayed.writeTo(w)
+	m.BytesRelayed.writeTo(w)
+	m.SendsDropped.writeTo(w)
+	m.SlowConsumerActions.writeTo(w)
+	writeQueueDepths(w, hub)
+	m.OversizeMessages.writeTo(w)
+	m.RateLimited.writeTo(w)
+	m.Resumptions.writeTo(w)
+	m.HandshakeRejections.writeTo(w)
+	m.ClusterEvents.writeTo(w)
+	m.ClusterEventsDropped.writeTo(w)
+	m.PlacementRedirects.writeTo(w)
+	m.ControlMessages.writeTo(w)
+	m.AuthMethods.writeTo(w)
+	m.Framing.writeTo(w)
+	m.CapabilityViolations.writeTo(w)
+	m.LobbyOutcomes.writeTo(w)
+	m.TransferOutcomes.writeTo(w)
+}
+
+// NewMetricsServer returns an HTTP server exposing /metrics on addr. It runs
+// on its own listener so metrics are never reachable through the public port.
+func NewMetricsServer(addr string, hub *Hub) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.WriteTo(w, hub)
+	})
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
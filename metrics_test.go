@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec_AddAndValue(t *testing.T) {
+	v := NewCounterVec("test_total", "Test counter.", "kind")
+
+	v.Inc("voice")
+	v.Add(5, "voice")
+	v.Inc("data")
+
+	if got := v.Value("voice"); got != 6 {
+		t.Errorf("voice = %d, want 6", got)
+	}
+	if got := v.Value("data"); got != 1 {
+		t.Errorf("data = %d, want 1", got)
+	}
+	if got := v.Value("other"); got != 0 {
+		t.Errorf("other = %d, want 0", got)
+	}
+}
+
+func TestRoom_Broadcast_CountsDrops(t *testing.T) {
+	room := NewRoom("metrics-room")
+
+	sender := &Client{peerID: "peer-1", connID: "conn-1", send: make(chan []byte, 1)}
+	slow := &Client{peerID: "peer-2", connID: "conn-2", send: make(chan []byte, 1), voice: make(chan *frameBuf, 1)}
+	room.Add(sender)
+	room.Add(slow)
+
+	before := metrics.SendsDropped.Value("voice")
+	voice := []byte{voiceMagic0, voiceMagic1, 0x01}
+	room.Broadcast("conn-1", voice)
+	room.Broadcast("conn-1", voice) // slow's buffer is full now
+
+	if got := metrics.SendsDropped.Value("voice") - before; got != 1 {
+		t.Errorf("dropped voice sends = %d, want 1", got)
+	}
+}
+
+func TestMetricsServer_Exposition(t *testing.T) {
+	hub := NewHub(testConfig())
+	room := NewRoom("room-1")
+	room.Add(&Client{peerID: "peer-1", connID: "conn-1", send: make(chan []byte, 1)})
+	hub.rooms["room-1"] = room
+
+	metrics.HandshakeRejections.Inc("room_full")
+
+	srv := NewMetricsServer(":0", hub)
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"relay_rooms 1\n",
+		"relay_clients 1\n",
+		"# TYPE relay_handshake_rejections_total counter\n",
+		`relay_handshake_rejections_total{reason="room_full"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output missing %q\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// ModerationCommand is the payload of the relay:kick, relay:mute,
+// relay:unmute, relay:approve, relay:deny and relay:successor control
+// messages. relay:lock and relay:unlock take none.
+type ModerationCommand struct {
+	Peer   string `json:"peer,omitempty"`
+	Reason string `json:"reason,omitempty"`  // logged only
+	PubKey string `json:"pubkey,omitempty"`  // relay:successor only
+	Policy string `json:"policy,omitempty"`  // slow_consumer, between nodes only
+	ConnID string `json:"conn_id,omitempty"` // relay:approve / relay:deny: conn_id from lobby:request
+
+	// TokenPeer is the peer_id in the target's token, when the host named
+	// the peer by the ID it announced instead. A mute is kept under both so
+	// it survives a reconnect. Set by the relay, between nodes only.
+	TokenPeer string `json:"token_peer,omitempty"`
+}
+
+// roomModeration is the state the host's moderation commands leave behind.
+// Kicks leave none: a kicked peer may rejoin unless it is also revoked.
+type roomModeration struct {
+	locked bool
+	lobby  bool            // guests wait for approval; see lobby.go
+	muted  map[string]bool // peer IDs whose voice is dropped
+
+	slowConsumer string // "" for the relay's default
+
+	// See hostleave.go. hostAwayGen numbers grace periods so a stale timer
+	// cannot close the room.
+	successor   []byte
+	hostAway    bool
+	hostAwayGen uint64
+}
+
+// moderationFor returns roomID's moderation state, creating it. The caller
+// must hold h.mu.
+func (h *Hub) moderationFor(roomID string) *roomModeration {
+	m, ok := h.moderation[roomID]
+	if !ok {
+		m = &roomModeration{muted: make(map[string]bool)}
+		h.moderation[roomID] = m
+	}
+	return m
+}
+
+func init() {
+	for _, typ := range []string{"relay:kick", "relay:mute", "relay:unmute", "relay:lock", "relay:unlock"} {
+		controlHandlers[typ] = moderationHandler(typ)
+	}
+}
+
+// moderationHandler returns the control handler for a moderation command.
+// Commands aimed at a peer need it to be a guest somewhere in the room.
+func moderationHandler(typ string) controlHandler {
+	return func(h *Hub, host *Client, payload json.RawMessage) *RelayError {
+		var cmd ModerationCommand
+		if len(payload) > 0 && string(payload) != "null" {
+			if err := json.Unmarshal(payload, &cmd); err != nil {
+				return &RelayError{Code: "invalid_control", Message: "malformed " + typ + " payload"}
+			}
+		}
+		switch typ {
+		case "relay:kick", "relay:mute", "relay:unmute":
+			if cmd.Peer == "" {
+				return &RelayError{Code: "invalid_control", Message: typ + " needs a peer"}
+			}
+			if !h.hasGuest(host.roomID, cmd.Peer) {
+				return &RelayError{Code: "unknown_peer", Message: "no guest " + cmd.Peer + " in room", Peers: []string{cmd.Peer}}
+			}
+		}
+		cmd.TokenPeer = ""
+		if typ == "relay:mute" || typ == "relay:unmute" {
+			cmd.TokenPeer = h.tokenPeerOf(host.roomID, cmd.Peer)
+		}
+		if cmd.Reason != "" {
+			log.Printf("room %s: %s %s: %s", host.roomID, typ, cmd.Peer, cmd.Reason)
+		}
+		h.moderate(host.roomID, typ, &cmd)
+		h.publish(&ClusterEvent{Type: clusterModerate, RoomID: host.roomID, Control: typ, Moderation: &cmd})
+		return nil
+	}
+}
+
+// moderate applies a verified moderation command to roomID, whether it came
+// from a local host or from another node. It runs on the room's shard.
+func (h *Hub) moderate(roomID, typ string, cmd *ModerationCommand) {
+	h.mu.Lock()
+	m := h.moderationFor(roomID)
+	switch typ {
+	case "relay:lock", "relay:unlock":
+		m.locked = typ == "relay:lock"
+	case "relay:mute":
+		m.muted[cmd.Peer] = true
+		if cmd.TokenPeer != "" {
+			m.muted[cmd.TokenPeer] = true
+		}
+	case "relay:unmute":
+		delete(m.muted, cmd.Peer)
+		delete(m.muted, cmd.TokenPeer)
+	case "lobby":
+		m.lobby = true
+	case "slow_consumer":
+		m.slowConsumer = cmd.Policy
+		if room := h.rooms[roomID]; room != nil {
+			room.setSlowConsumer(cmd.Policy)
+		}
+	case "relay:successor":
+		m.successor, _ = base64.RawURLEncoding.DecodeString(cmd.PubKey)
+		if len(m.successor) == 0 {
+			m.successor = nil
+		}
+	}
+	room := h.rooms[roomID]
+	h.mu.Unlock()
+
+	switch {
+	case typ == "relay:approve" || typ == "relay:deny":
+		h.settleLobby(roomID, typ, cmd)
+		return
+	case room == nil:
+		return
+	}
+	for _, c := range room.Clients() {
+		if c.role == "host" || (c.PeerID() != cmd.Peer && c.tokenPeerID != cmd.Peer) {
+			continue
+		}
+		switch typ {
+		case "relay:kick":
+			log.Printf("peer %s (conn=%s) kicked from room %s", c.PeerID(), c.connID[:8], roomID)
+			h.evict(c, websocket.ClosePolicyViolation, "kicked by host")
+		case "relay:mute", "relay:unmute":
+			muted := typ == "relay:mute"
+			if c.muted.Swap(muted) != muted {
+				c.trySend(newEnvelope(typ+"d", relayPeerID, nil))
+			}
+		}
+	}
+}
+
+// hasGuest reports whether a guest with peerID is connected to roomID on
+// this node or another one.
+func (h *Hub) hasGuest(roomID, peerID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if room := h.rooms[roomID]; room != nil {
+		for _, c := range room.Clients() {
+			if c.role != "host" && (c.PeerID() == peerID || c.tokenPeerID == peerID) {
+				return true
+			}
+		}
+	}
+	for _, p := range h.remote[roomID] {
+		if p.info.Role != "host" && p.info.PeerID == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenPeerOf returns the token peer ID of the local guest of roomID that
+// announced itself as peerID, or "" if there is none or the IDs agree.
+func (h *Hub) tokenPeerOf(roomID, peerID string) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if room := h.rooms[roomID]; room != nil {
+		for _, c := range room.Clients() {
+			if c.role != "host" && c.PeerID() == peerID && c.tokenPeerID != peerID {
+				return c.tokenPeerID
+			}
+		}
+	}
+	return ""
+}
+
+// Locked reports whether the host has locked roomID against new guests.
+func (h *Hub) Locked(roomID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	m, ok := h.moderation[roomID]
+	return ok && m.locked
+}
+
+// muted reports whether the host has muted peerID in roomID. The caller must
+// hold h.mu.
+func (h *Hub) muted(roomID, peerID string) bool {
+	m, ok := h.moderation[roomID]
+	return ok && m.muted[peerID]
+}
+
+// moderationEvents describes roomID's moderation state as cluster events,
+// for a snapshot. The caller must hold h.mu.
+func (h *Hub) moderationEvents(roomID string) []*ClusterEvent {
+	m, ok := h.moderation[roomID]
+	if !ok {
+		return nil
+	}
+	var events []*ClusterEvent
+	if m.slowConsumer != "" {
+		events = append(events, &ClusterEvent{Type: clusterModerate, RoomID: roomID, Control: "slow_consumer", Moderation: &ModerationCommand{Policy: m.slowConsumer}})
+	}
+	if m.lobby {
+		events = append(events, &ClusterEvent{Type: clusterModerate, RoomID: roomID, Control: "lobby", Moderation: &ModerationCommand{}})
+	}
+	if m.locked {
+		events = append(events, &ClusterEvent{Type: clusterModerate, RoomID: roomID, Control: "relay:lock", Moderation: &ModerationCommand{}})
+	}
+	if m.successor != nil {
+		events = append(events, &ClusterEvent{Type: clusterModerate, RoomID: roomID, Control: "relay:successor",
+			Moderation: &ModerationCommand{PubKey: base64.RawURLEncoding.EncodeToString(m.successor)}})
+	}
+	for id := range m.muted {
+		events = append(events, &ClusterEvent{Type: clusterModerate, RoomID: roomID, Control: "relay:mute", Moderation: &ModerationCommand{Peer: id}})
+	}
+	return events
+}
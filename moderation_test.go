@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestControl_Kick(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	host, priv := joinAsHost(t, tr, "room-1")
+	guestJWT := guestToken(priv, "room-1", "guest-1")
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestJWT}})
+	readEnvelope(t, host, "session:join")
+
+	_ = host.WriteMessage(websocket.BinaryMessage,
+		SignControl(priv, "room-1", "relay:kick", 1, &ModerationCommand{Peer: "nobody"}))
+	if e := readEnvelope(t, host, "relay:error"); e["payload"].(map[string]any)["code"] != "unknown_peer" {
+		t.Errorf("kick unknown peer error = %v", e["payload"])
+	}
+
+	_ = host.WriteMessage(websocket.BinaryMessage,
+		SignControl(priv, "room-1", "relay:kick", 2, &ModerationCommand{Peer: "guest-1", Reason: "spam"}))
+	readEnvelope(t, host, "relay:ack")
+	_ = guest.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := guest.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("expected close 1008, got %v", err)
+			}
+			break
+		}
+	}
+
+	// Unlike a revocation, a kick does not keep the peer out.
+	tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestJWT}})
+}
+
+func TestControl_Mute(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxVoiceSize = 4096
+	tr := newTestRelay(t, cfg)
+	host, priv := joinAsHost(t, tr, "room-1")
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	readEnvelope(t, guest, "session:roster")
+	readEnvelope(t, host, "session:join")
+
+	voice := []byte{voiceMagic0, voiceMagic1, 1, 2, 3}
+
+	_ = host.WriteMessage(websocket.BinaryMessage,
+		SignControl(priv, "room-1", "relay:mute", 1, &ModerationCommand{Peer: "guest-1"}))
+	readEnvelope(t, host, "relay:ack")
+	readEnvelope(t, guest, "relay:muted")
+
+	// The muted voice is dropped; the data message after it still arrives.
+	_ = guest.WriteMessage(websocket.BinaryMessage, voice)
+	_ = guest.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"chat","from":"guest-1"}`))
+	_ = host.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, msg, err := host.ReadMessage(); err != nil || isVoicePacket(msg) {
+		t.Fatalf("host got %q, %v; want the chat message only", msg, err)
+	}
+
+	_ = host.WriteMessage(websocket.BinaryMessage,
+		SignControl(priv, "room-1", "relay:unmute", 2, &ModerationCommand{Peer: "guest-1"}))
+	readEnvelope(t, host, "relay:ack")
+	readEnvelope(t, guest, "relay:unmuted")
+
+	_ = guest.WriteMessage(websocket.BinaryMessage, voice)
+	_ = host.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, msg, err := host.ReadMessage(); err != nil || !isVoicePacket(msg) {
+		t.Errorf("host got %q, %v; want the voice packet", msg, err)
+	}
+}
+
+func TestControl_MuteSurvivesReconnect(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxVoiceSize = 4096
+	tr := newTestRelay(t, cfg)
+	host, priv := joinAsHost(t, tr, "room-1")
+	guestJWT := guestToken(priv, "room-1", "guest-1")
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestJWT}})
+	readEnvelope(t, host, "session:join")
+
+	// The guest announces an ID of its own; the host mutes it by that ID.
+	_ = guest.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"chat","from":"alias-1"}`))
+	readEnvelope(t, host, "chat")
+	_ = host.WriteMessage(websocket.BinaryMessage,
+		SignControl(priv, "room-1", "relay:mute", 1, &ModerationCommand{Peer: "alias-1"}))
+	readEnvelope(t, host, "relay:ack")
+	readEnvelope(t, guest, "relay:muted")
+
+	// Reconnecting with the same token does not lift the mute.
+	guest.Close()
+	readEnvelope(t, host, "session:leave")
+	guest = tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestJWT}})
+	readEnvelope(t, host, "session:join")
+	_ = guest.WriteMessage(websocket.BinaryMessage, []byte{voiceMagic0, voiceMagic1, 1, 2, 3})
+	_ = guest.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"chat","from":"alias-1"}`))
+	_ = host.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, msg, err := host.ReadMessage(); err != nil || isVoicePacket(msg) {
+		t.Fatalf("host got %q, %v; want the chat message only", msg, err)
+	}
+}
+
+func TestControl_LockRoom(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	host, priv := joinAsHost(t, tr, "room-1")
+
+	_ = host.WriteMessage(websocket.BinaryMessage, SignControl(priv, "room-1", "relay:lock", 1, nil))
+	readEnvelope(t, host, "relay:ack")
+
+	q := url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}}
+	if status := tr.dialStatus(t, q); status != http.StatusForbidden {
+		t.Errorf("locked room status = %d, want 403", status)
+	}
+
+	_ = host.WriteMessage(websocket.BinaryMessage, SignControl(priv, "room-1", "relay:unlock", 2, nil))
+	readEnvelope(t, host, "relay:ack")
+	tr.dial(t, q)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// placementVnodes is the number of points each node gets on the hash ring.
+// More points spread rooms more evenly at the cost of a larger ring.
+const placementVnodes = 128
+
+// closeRedirect is the close code sent, with the owning node's /ws URL as the
+// reason, when RELAY_PLACEMENT_REDIRECT=close.
+const closeRedirect = 4307
+
+// placementRing assigns room IDs to nodes by consistent hashing. Every node
+// owns the arcs that end at its points, so adding or removing a node only
+// moves the rooms on the arcs it gains or loses.
+type placementRing struct {
+	points []ringPoint // sorted by hash
+	urls   map[string]string
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// parsePlacement builds a ring from "node-id=url" entries, where url is the
+// node's public base URL (e.g. wss://relay-2.example.com). An empty list
+// returns a nil ring, which disables placement.
+func parsePlacement(entries []string) (*placementRing, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	r := &placementRing{urls: make(map[string]string, len(entries))}
+	for _, e := range entries {
+		id, raw, ok := strings.Cut(e, "=")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid entry %q: want node-id=url", e)
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" || !(u.Scheme == "ws" || u.Scheme == "wss" || u.Scheme == "http" || u.Scheme == "https") {
+			return nil, fmt.Errorf("invalid URL for node %s: %q", id, raw)
+		}
+		if _, dup := r.urls[id]; dup {
+			return nil, fmt.Errorf("duplicate node %s", id)
+		}
+		r.urls[id] = strings.TrimSuffix(raw, "/")
+		for i := 0; i < placementVnodes; i++ {
+			r.points = append(r.points, ringPoint{hash: ringHash(id + "#" + strconv.Itoa(i)), node: id})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r, nil
+}
+
+func ringHash(s string) uint64 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(s))
+	// FNV leaves similar inputs close together; mix the bits so the
+	// "node#i" points spread over the whole ring.
+	h := f.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h
+}
+
+// Owner returns the node that owns roomID and its base URL.
+func (r *placementRing) Owner(roomID string) (node, baseURL string) {
+	h := ringHash(roomID)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	node = r.points[i].node
+	return node, r.urls[node]
+}
+
+// ownerURL returns the /ws URL of the node that owns roomID, or "" if this
+// node owns it or placement is disabled.
+func (s *Server) ownerURL(roomID string) string {
+	if s.cfg.Placement == nil {
+		return ""
+	}
+	owner, base := s.cfg.Placement.Owner(roomID)
+	if owner == s.cfg.NodeID {
+		return ""
+	}
+	return base + "/ws"
+}
+
+// redirectToOwner sends a client that asked for a room owned by another node
+// to that node's /ws endpoint, either with a 307 or, for clients that cannot
+// follow HTTP redirects on a WebSocket handshake, with a close frame. It
+// returns false if this node owns the room.
+func (s *Server) redirectToOwner(w http.ResponseWriter, r *http.Request, roomID string) bool {
+	target := s.ownerURL(roomID)
+	if target == "" {
+		return false
+	}
+
+	if s.cfg.PlacementRedirect == "close" {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return true
+		}
+		closeWithRedirect(conn, target)
+		return true
+	}
+
+	// The query carries the credentials; it is forwarded as-is.
+	http.Redirect(w, r, target+"?"+r.URL.RawQuery, http.StatusTemporaryRedirect)
+	metrics.PlacementRedirects.Inc("http")
+	return true
+}
+
+// closeWithRedirect closes an upgraded connection with the owning node's URL
+// as the close reason.
+func closeWithRedirect(conn *websocket.Conn, target string) {
+	_ = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(closeRedirect, target), time.Now().Add(writeWait))
+	conn.Close()
+	metrics.PlacementRedirects.Inc("close")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func testRing(t *testing.T, nodes ...string) *placementRing {
+	t.Helper()
+	var entries []string
+	for _, n := range nodes {
+		entries = append(entries, n+"=wss://"+n+".example.com")
+	}
+	r, err := parsePlacement(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestPlacement_ParseErrors(t *testing.T) {
+	for _, entries := range [][]string{
+		{"relay-1"},
+		{"=wss://a.example.com"},
+		{"relay-1=not a url"},
+		{"relay-1=ftp://a.example.com"},
+		{"relay-1=wss://a.example.com", "relay-1=wss://b.example.com"},
+	} {
+		if _, err := parsePlacement(entries); err == nil {
+			t.Errorf("parsePlacement(%q) succeeded", entries)
+		}
+	}
+	if r, err := parsePlacement(nil); r != nil || err != nil {
+		t.Errorf("empty list = %v, %v; want placement disabled", r, err)
+	}
+}
+
+func TestPlacement_OnlyAffectedRoomsMove(t *testing.T) {
+	before := testRing(t, "a", "b", "c")
+	grown := testRing(t, "a", "b", "c", "d")
+	shrunk := testRing(t, "a", "c")
+
+	const rooms = 10000
+	counts := map[string]int{}
+	movedOnGrow, movedOnShrink := 0, 0
+	for i := 0; i < rooms; i++ {
+		id := fmt.Sprintf("room-%d", i)
+		was, _ := before.Owner(id)
+		counts[was]++
+
+		if now, _ := grown.Owner(id); now != was {
+			movedOnGrow++
+			if now != "d" {
+				t.Fatalf("%s moved from %s to %s when d joined", id, was, now)
+			}
+		}
+		if now, _ := shrunk.Owner(id); now != was {
+			movedOnShrink++
+			if was != "b" {
+				t.Fatalf("%s moved from %s to %s when b left", id, was, now)
+			}
+		}
+	}
+
+	// Each node should own roughly a third of the rooms.
+	for node, n := range counts {
+		if n < rooms/5 || n > rooms/2 {
+			t.Errorf("node %s owns %d of %d rooms", node, n, rooms)
+		}
+	}
+	if movedOnGrow == 0 || movedOnGrow > rooms/2 {
+		t.Errorf("%d rooms moved when a fourth node joined", movedOnGrow)
+	}
+	if movedOnShrink != counts["b"] {
+		t.Errorf("%d rooms moved when b left, want b's %d", movedOnShrink, counts["b"])
+	}
+}
+
+// foreignRoom returns a room ID that ring assigns to a node other than self.
+func foreignRoom(t *testing.T, ring *placementRing, self string) (roomID, owner string) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("room-%d", i)
+		if node, _ := ring.Owner(id); node != self {
+			return id, node
+		}
+	}
+	t.Fatal("no foreign room found")
+	return "", ""
+}
+
+func TestHandleWS_RedirectsToOwner(t *testing.T) {
+	cfg := testConfig()
+	cfg.NodeID = "a"
+	cfg.Placement = testRing(t, "a", "b")
+	srv := NewServer(cfg, NewHub(cfg))
+
+	roomID, owner := foreignRoom(t, cfg.Placement, "a")
+	q := url.Values{"room": {roomID}, "token": {"t"}}
+	rec := httptest.NewRecorder()
+	srv.handleWS(rec, httptest.NewRequest("GET", "/ws?"+q.Encode(), nil))
+
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("status = %d, want 307", rec.Code)
+	}
+	want := "wss://" + owner + ".example.com/ws?" + q.Encode()
+	if loc := rec.Header().Get("Location"); loc != want {
+		t.Errorf("Location = %q, want %q", loc, want)
+	}
+}
+
+func TestHandleWS_RedirectCloseFrame(t *testing.T) {
+	cfg := testConfig()
+	cfg.NodeID = "a"
+	cfg.Placement = testRing(t, "a", "b")
+	cfg.PlacementRedirect = "close"
+	tr := newTestRelay(t, cfg)
+
+	roomID, owner := foreignRoom(t, cfg.Placement, "a")
+	conn := tr.dial(t, url.Values{"room": {roomID}, "token": {"t"}})
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	ce, ok := err.(*websocket.CloseError)
+	if !ok || ce.Code != closeRedirect {
+		t.Fatalf("expected close %d, got %v", closeRedirect, err)
+	}
+	if !strings.HasPrefix(ce.Text, "wss://"+owner+".example.com/ws") {
+		t.Errorf("close reason = %q", ce.Text)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader_V1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 198.51.100.4 10.0.0.1 40000 8443\r\nGET / HTTP/1.1\r\n"))
+
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatalf("readProxyHeader: %v", err)
+	}
+	if addr.String() != "198.51.100.4:40000" {
+		t.Errorf("addr = %s, want 198.51.100.4:40000", addr)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("stream after header = %q", rest)
+	}
+}
+
+func TestReadProxyHeader_V1Unknown(t *testing.T) {
+	addr, err := readProxyHeader(bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\nGET /")))
+	if err != nil || addr != nil {
+		t.Errorf("got addr=%v err=%v, want nil/nil", addr, err)
+	}
+}
+
+func TestReadProxyHeader_V2(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Sig)
+	buf.WriteByte(0x21) // version 2, PROXY
+	buf.WriteByte(0x21) // TCP over IPv6
+	_ = binary.Write(&buf, binary.BigEndian, uint16(36))
+	buf.Write(net.ParseIP("2001:db8::1").To16())
+	buf.Write(net.ParseIP("2001:db8::2").To16())
+	_ = binary.Write(&buf, binary.BigEndian, uint16(50000))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(8443))
+	buf.WriteString("payload")
+
+	r := bufio.NewReader(&buf)
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatalf("readProxyHeader: %v", err)
+	}
+	if addr.String() != "[2001:db8::1]:50000" {
+		t.Errorf("addr = %s", addr)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "payload" {
+		t.Errorf("stream after header = %q", rest)
+	}
+}
+
+func TestReadProxyHeader_NoHeader(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("GET /health HTTP/1.1\r\n"))
+	addr, err := readProxyHeader(r)
+	if err != nil || addr != nil {
+		t.Errorf("got addr=%v err=%v, want nil/nil", addr, err)
+	}
+	rest, _ := io.ReadAll(r)
+	if !strings.HasPrefix(string(rest), "GET /health") {
+		t.Error("non-PROXY stream was consumed")
+	}
+}
+
+func TestProxyProtoListener_RemoteAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pl := newProxyProtoListener(ln, nil)
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = c.Write([]byte("PROXY TCP4 203.0.113.5 127.0.0.1 1234 8443\r\nhello"))
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if got := conn.RemoteAddr().String(); got != "203.0.113.5:1234" {
+		t.Errorf("RemoteAddr = %s, want 203.0.113.5:1234", got)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+}
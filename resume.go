@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+)
+
+// resumeRequest asks a shard to hand a detached client's identity over to a
+// freshly connected one.
+type resumeRequest struct {
+	client *Client
+	token  string
+}
+
+// ResumeInfo is the payload of the session:resume_token and session:resumed
+// envelopes.
+type ResumeInfo struct {
+	Token    string `json:"token"`
+	GraceMs  int64  `json:"grace_ms"`
+	Replayed int    `json:"replayed,omitempty"`
+	Gap      bool   `json:"gap,omitempty"`
+}
+
+func newResumeToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Resume attaches c to the detached connection identified by token. c was
+// admitted as a resumption, so if the token has expired by the time the shard
+// processes it, c is refused rather than joined.
+func (h *Hub) Resume(c *Client, token string) {
+	h.shardFor(c.roomID).resumeCh <- &resumeRequest{client: c, token: token}
+}
+
+// CanResume reports whether token currently refers to a resumable connection
+// of peerID in roomID. handleWS uses it to exempt resuming clients from the
+// room-size check, since they take over an existing slot.
+func (h *Hub) CanResume(token, roomID, peerID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	old, ok := h.resumeTokens[token]
+	return ok && old.roomID == roomID && old.tokenPeerID == peerID
+}
+
+// issueResumeToken registers a fresh resumption token for c.
+func (h *Hub) issueResumeToken(c *Client) string {
+	token := newResumeToken()
+	h.mu.Lock()
+	h.resumeTokens[token] = c
+	h.mu.Unlock()
+	c.resumeToken = token
+	return token
+}
+
+// detach keeps a client that lost its connection in the room for the grace
+// period. Peers see no leave; messages for it accumulate in its send buffer.
+func (h *Hub) detach(c *Client) {
+	c.mu.Lock()
+	c.detached = true
+	c.mu.Unlock()
+
+	log.Printf("peer %s (conn=%s) detached from room %s, resumable for %s", c.peerID, c.connID[:8], c.roomID, h.cfg.ResumeGrace)
+	time.AfterFunc(h.cfg.ResumeGrace, func() {
+		h.shardFor(c.roomID).expireCh <- c
+	})
+}
+
+// expire removes a detached client whose grace period ran out, unless it has
+// been resumed (replaced in the room) in the meantime.
+func (h *Hub) expire(c *Client) {
+	h.mu.RLock()
+	room, ok := h.rooms[c.roomID]
+	h.mu.RUnlock()
+	if !ok || room.Get(c.connID) != c {
+		return
+	}
+	metrics.Resumptions.Inc("expired")
+	h.dropClient(c)
+}
+
+func (h *Hub) resumeClient(req *resumeRequest) {
+	c := req.client
+
+	h.mu.Lock()
+	old, ok := h.resumeTokens[req.token]
+	room := h.rooms[c.roomID]
+	ok = ok && room != nil && old.roomID == c.roomID && old.tokenPeerID == c.tokenPeerID && room.Get(old.connID) == old
+	if ok {
+		delete(h.resumeTokens, req.token)
+	}
+	h.mu.Unlock()
+
+	if !ok {
+		// c skipped the admission checks a fresh join goes through.
+		metrics.Resumptions.Inc("refused")
+		go refuse(c.conn, &rejection{"resume_expired", "session can no longer be resumed", http.StatusGone})
+		return
+	}
+
+	// Retire the old client without closing its send channel: the buffered
+	// messages are handed to the new connection and replayed in order. The
+	// old connection may still be a half-open zombie, so stop it explicitly.
+	old.mu.Lock()
+	old.closed = true
+	gap := old.replayGap
+	old.mu.Unlock()
+	old.closeOnce.Do(func() {})
+	old.stop()
+	old.conn.Close()
+
+	c.connID = old.connID
+	c.peerID = old.PeerID()
+	c.send = old.send
+	c.dataBytes.Store(old.dataBytes.Load())
+	c.muted.Store(old.muted.Load())
+	room.Add(c)
+
+	metrics.Resumptions.Inc("resumed")
+	log.Printf("peer %s (conn=%s) resumed in room %s (%d buffered)", c.peerID, c.connID[:8], c.roomID, len(c.send))
+
+	c.trySend(newEnvelope("session:resumed", relayPeerID, &ResumeInfo{
+		Token:    h.issueResumeToken(c),
+		GraceMs:  h.cfg.ResumeGrace.Milliseconds(),
+		Replayed: len(c.send),
+		Gap:      gap,
+	}))
+
+	c.start()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestResume_ReplaysMissedMessages(t *testing.T) {
+	cfg := testConfig()
+	cfg.ResumeGrace = 5 * time.Second
+	tr := newTestRelay(t, cfg)
+
+	pub, priv, hostJWT := hostToken(t, "room-1")
+	host := tr.dial(t, url.Values{
+		"room":   {"room-1"},
+		"token":  {hostJWT},
+		"pubkey": {base64.RawURLEncoding.EncodeToString(pub)},
+	})
+	readEnvelope(t, host, "session:resume_token")
+
+	guestJWT := guestToken(priv, "room-1", "guest-1")
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestJWT}})
+	payload := readEnvelope(t, guest, "session:resume_token")["payload"].(map[string]any)
+	token := payload["token"].(string)
+
+	// Drop the guest's TCP connection without a close handshake.
+	guest.UnderlyingConn().Close()
+	time.Sleep(100 * time.Millisecond)
+
+	_ = host.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"chat","n":1}`))
+	_ = host.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"chat","n":2}`))
+	time.Sleep(100 * time.Millisecond)
+
+	resumed := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestJWT}, "resume": {token}})
+	_ = resumed.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, batch, err := resumed.ReadMessage()
+	if err != nil {
+		t.Fatalf("read replay: %v", err)
+	}
+	// Buffered data messages are flushed as one newline-separated batch,
+	// followed by the session:resumed notice.
+	lines := strings.Split(string(batch), "\n")
+	want := []string{`{"type":"chat","n":1}`, `{"type":"chat","n":2}`}
+	if len(lines) != 3 || lines[0] != want[0] || lines[1] != want[1] {
+		t.Fatalf("replay batch = %q, want %v then session:resumed", batch, want)
+	}
+	var notice struct {
+		Type    string     `json:"type"`
+		Payload ResumeInfo `json:"payload"`
+	}
+	if err := json.Unmarshal([]byte(lines[2]), &notice); err != nil || notice.Type != "session:resumed" {
+		t.Fatalf("expected session:resumed, got %q", lines[2])
+	}
+	info := notice.Payload
+	if info.Replayed != 2 {
+		t.Errorf("replayed = %d, want 2", info.Replayed)
+	}
+	if info.Token == token || info.Token == "" {
+		t.Error("resumption should issue a fresh token")
+	}
+
+	// The host must not have seen the guest leave.
+	_ = host.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, msg, err := host.ReadMessage(); err == nil && strings.Contains(string(msg), "session:leave") {
+		t.Errorf("host saw a leave during resumption: %s", msg)
+	}
+	if n := tr.hub.ClientCount("room-1"); n != 2 {
+		t.Errorf("ClientCount = %d, want 2", n)
+	}
+}
+
+func TestResume_ExpiredGraceEmitsLeave(t *testing.T) {
+	cfg := testConfig()
+	cfg.ResumeGrace = 200 * time.Millisecond
+	tr := newTestRelay(t, cfg)
+
+	pub, priv, hostJWT := hostToken(t, "room-1")
+	host := tr.dial(t, url.Values{
+		"room":   {"room-1"},
+		"token":  {hostJWT},
+		"pubkey": {base64.RawURLEncoding.EncodeToString(pub)},
+	})
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	readEnvelope(t, guest, "session:resume_token")
+
+	guest.UnderlyingConn().Close()
+
+	leave := readEnvelope(t, host, "session:leave")
+	if leave["from"] != "guest-1" {
+		t.Errorf("leave from %v, want guest-1", leave["from"])
+	}
+}
+
+func TestResume_OtherPeersTokenGetsNoExemption(t *testing.T) {
+	cfg := testConfig()
+	cfg.ResumeGrace = 5 * time.Second
+	cfg.MaxClientsPerRoom = 2
+	tr := newTestRelay(t, cfg)
+	_, priv := joinAsHost(t, tr, "room-1")
+
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	token := readEnvelope(t, guest, "session:resume_token")["payload"].(map[string]any)["token"].(string)
+
+	// guest-1's live token does not let guest-2 into the full room.
+	other := url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-2")}, "resume": {token}}
+	if status := tr.dialStatus(t, other); status != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503 (room_full)", status)
+	}
+	if n := tr.hub.ClientCount("room-1"); n != 2 {
+		t.Errorf("ClientCount = %d, want 2", n)
+	}
+}
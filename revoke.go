@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// jtiDefaultTTL is how long a single-use token without an exp claim stays in
+// the replay cache.
+const jtiDefaultTTL = 24 * time.Hour
+
+// Revocation is the payload of a relay:revoke control message and the state
+// of a room's deny list.
+type Revocation struct {
+	JTIs  []string `json:"jtis,omitempty"`
+	Peers []string `json:"peers,omitempty"`
+}
+
+// denyList holds the token IDs and peer IDs a room's host has revoked.
+type denyList struct {
+	jtis  map[string]bool
+	peers map[string]bool
+}
+
+func init() {
+	controlHandlers["relay:revoke"] = func(h *Hub, host *Client, payload json.RawMessage) *RelayError {
+		var rev Revocation
+		if err := json.Unmarshal(payload, &rev); err != nil || len(rev.JTIs)+len(rev.Peers) == 0 {
+			return &RelayError{Code: "invalid_control", Message: "relay:revoke needs jtis or peers"}
+		}
+		h.revoke(host.roomID, &rev)
+		h.publish(&ClusterEvent{Type: clusterRevoke, RoomID: host.roomID, Revoke: &rev})
+		return nil
+	}
+}
+
+// ConsumeJTI records a single-use token as spent. It returns false if the
+// token was already used in roomID.
+func (h *Hub) ConsumeJTI(roomID string, claims *Claims) bool {
+	expires := time.Now().Add(jtiDefaultTTL)
+	if claims.ExpiresAt > 0 {
+		expires = time.Unix(claims.ExpiresAt, 0)
+	}
+
+	h.mu.Lock()
+	key := roomID + "\x00" + claims.JTI
+	if _, used := h.usedJTIs[key]; used {
+		h.mu.Unlock()
+		return false
+	}
+	h.usedJTIs[key] = expires
+	h.mu.Unlock()
+
+	h.publish(&ClusterEvent{Type: clusterJTI, RoomID: roomID, JTI: claims.JTI, Expires: expires.Unix()})
+	return true
+}
+
+// Revoked reports whether the host of roomID has revoked the token or the
+// peer it was issued to.
+func (h *Hub) Revoked(roomID string, claims *Claims) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	d, ok := h.denied[roomID]
+	if !ok {
+		return false
+	}
+	return (claims.JTI != "" && d.jtis[claims.JTI]) || d.peers[claims.PeerID]
+}
+
+// revoke adds rev to roomID's deny list and disconnects the guests it
+// matches. It runs on the room's shard.
+func (h *Hub) revoke(roomID string, rev *Revocation) {
+	h.mu.Lock()
+	d, ok := h.denied[roomID]
+	if !ok {
+		d = &denyList{jtis: make(map[string]bool), peers: make(map[string]bool)}
+		h.denied[roomID] = d
+	}
+	for _, jti := range rev.JTIs {
+		d.jtis[jti] = true
+	}
+	for _, id := range rev.Peers {
+		d.peers[id] = true
+	}
+	room := h.rooms[roomID]
+	h.mu.Unlock()
+
+	if room == nil {
+		return
+	}
+	for _, c := range room.Clients() {
+		if c.role == "host" {
+			continue
+		}
+		if (c.jti != "" && d.jtis[c.jti]) || d.peers[c.tokenPeerID] || d.peers[c.PeerID()] {
+			log.Printf("peer %s (conn=%s) revoked in room %s", c.PeerID(), c.connID[:8], roomID)
+			h.evict(c, websocket.ClosePolicyViolation, "token revoked")
+		}
+	}
+}
+
+// revocations returns a copy of roomID's deny list, or nil.
+func (h *Hub) revocations(roomID string) *Revocation {
+	d, ok := h.denied[roomID]
+	if !ok {
+		return nil
+	}
+	rev := &Revocation{}
+	for jti := range d.jtis {
+		rev.JTIs = append(rev.JTIs, jti)
+	}
+	for id := range d.peers {
+		rev.Peers = append(rev.Peers, id)
+	}
+	return rev
+}
+
+// pruneJTIs forgets spent tokens that have expired; they can no longer be
+// presented anyway. The caller must hold h.mu.
+func (h *Hub) pruneJTIs(now time.Time) {
+	for key, expires := range h.usedJTIs {
+		if now.After(expires) {
+			delete(h.usedJTIs, key)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func inviteToken(priv ed25519.PrivateKey, roomID, peerID, jti string) string {
+	return SignJWT(&Claims{
+		RoomID:    roomID,
+		PeerID:    peerID,
+		Role:      "guest",
+		CreatedAt: time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		JTI:       jti,
+	}, priv)
+}
+
+// dialStatus attempts a handshake that is expected to fail and returns the
+// HTTP status.
+func (tr *testRelay) dialStatus(t *testing.T, q url.Values) int {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(tr.url+"?"+q.Encode(), nil)
+	if err == nil {
+		conn.Close()
+		t.Fatal("handshake unexpectedly succeeded")
+	}
+	if resp == nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return resp.StatusCode
+}
+
+func joinAsHost(t testing.TB, tr *testRelay, roomID string) (*websocket.Conn, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, hostJWT := hostToken(t, roomID)
+	host := tr.dial(t, url.Values{
+		"room":   {roomID},
+		"token":  {hostJWT},
+		"pubkey": {base64.RawURLEncoding.EncodeToString(pub)},
+	})
+	readEnvelope(t, host, "session:roster")
+	return host, priv
+}
+
+func TestHandleWS_SingleUseInvite(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	_, priv := joinAsHost(t, tr, "room-1")
+
+	invite := inviteToken(priv, "room-1", "guest-1", "invite-42")
+	tr.dial(t, url.Values{"room": {"room-1"}, "token": {invite}})
+
+	before := metrics.HandshakeRejections.Value("token_reused")
+	if status := tr.dialStatus(t, url.Values{"room": {"room-1"}, "token": {invite}}); status != http.StatusForbidden {
+		t.Errorf("reused invite status = %d, want 403", status)
+	}
+	if got := metrics.HandshakeRejections.Value("token_reused") - before; got != 1 {
+		t.Errorf("token_reused rejections = %d, want 1", got)
+	}
+
+	// Tokens without a jti stay reusable.
+	plain := guestToken(priv, "room-1", "guest-2")
+	tr.dial(t, url.Values{"room": {"room-1"}, "token": {plain}})
+	tr.dial(t, url.Values{"room": {"room-1"}, "token": {plain}})
+}
+
+func TestControl_RevokeDisconnectsAndDenies(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	host, priv := joinAsHost(t, tr, "room-1")
+
+	guestJWT := guestToken(priv, "room-1", "guest-1")
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestJWT}})
+	invited := tr.dial(t, url.Values{"room": {"room-1"}, "token": {inviteToken(priv, "room-1", "guest-2", "jti-2")}})
+	readEnvelope(t, guest, "session:roster")
+	readEnvelope(t, invited, "session:roster")
+
+	_ = host.WriteMessage(websocket.BinaryMessage,
+		SignControl(priv, "room-1", "relay:revoke", 1, &Revocation{Peers: []string{"guest-1"}, JTIs: []string{"jti-2"}}))
+	readEnvelope(t, host, "relay:ack")
+
+	for _, conn := range []*websocket.Conn{guest, invited} {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+					t.Errorf("expected close 1008, got %v", err)
+				}
+				break
+			}
+		}
+	}
+
+	if status := tr.dialStatus(t, url.Values{"room": {"room-1"}, "token": {guestJWT}}); status != http.StatusForbidden {
+		t.Errorf("revoked peer status = %d, want 403", status)
+	}
+}
+
+func TestControl_RejectsUnauthorized(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	host, priv := joinAsHost(t, tr, "room-1")
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	readEnvelope(t, host, "session:join")
+
+	revoke := SignControl(priv, "room-1", "relay:revoke", 7, &Revocation{Peers: []string{"host-1"}})
+
+	// A guest cannot send control messages, even validly signed ones, and
+	// they are not forwarded to the room.
+	_ = guest.WriteMessage(websocket.BinaryMessage, revoke)
+	if e := readEnvelope(t, guest, "relay:error"); e["payload"].(map[string]any)["code"] != "forbidden" {
+		t.Errorf("guest control error = %v", e["payload"])
+	}
+
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	_ = host.WriteMessage(websocket.BinaryMessage,
+		SignControl(otherKey, "room-1", "relay:revoke", 8, &Revocation{Peers: []string{"guest-1"}}))
+	if e := readEnvelope(t, host, "relay:error"); e["payload"].(map[string]any)["code"] != "invalid_signature" {
+		t.Errorf("forged control error = %v", e["payload"])
+	}
+
+	_ = host.WriteMessage(websocket.BinaryMessage, revoke)
+	readEnvelope(t, host, "relay:ack")
+	_ = host.WriteMessage(websocket.BinaryMessage, revoke)
+	if e := readEnvelope(t, host, "relay:error"); e["payload"].(map[string]any)["code"] != "replayed_control" {
+		t.Errorf("replayed control error = %v", e["payload"])
+	}
+
+	// The guest never saw any of it.
+	_ = guest.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, msg, err := guest.ReadMessage(); err == nil {
+		t.Errorf("guest received %s", msg)
+	}
+}
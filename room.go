@@ -2,6 +2,7 @@ package main
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,12 +11,19 @@ type Room struct {
 	mu           sync.RWMutex
 	clients      map[string]*Client
 	lastActivity time.Time
+	bytesRelayed atomic.Uint64
+	slowConsumer string // policy for peers whose queue is full; see slowconsumer.go
+
+	// transfers are the chunked transfers in flight, by transferKey. They
+	// are only used on the room's shard; see transfer.go.
+	transfers map[string]*transfer
 }
 
 func NewRoom(id string) *Room {
 	return &Room{
 		id:           id,
 		clients:      make(map[string]*Client),
+		transfers:    make(map[string]*transfer),
 		lastActivity: time.Now(),
 	}
 }
@@ -47,20 +55,132 @@ func (r *Room) LastActivity() time.Time {
 }
 
 func (r *Room) Broadcast(senderConnID string, data []byte) {
+	if isVoicePacket(data) {
+		f := frameOf(data)
+		r.broadcastFrame(senderConnID, f)
+		f.release()
+		return
+	}
+
+	r.mu.Lock()
+	r.lastActivity = time.Now()
+	r.mu.Unlock()
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
+	kind := packetKind(data)
+	for _, c := range r.clients {
+		if c.connID == senderConnID {
+			continue
+		}
+		r.deliver(c, data, kind)
+	}
+}
+
+// broadcastFrame fans a voice frame out to the room. The frame is encoded
+// once and shared by every recipient's queue.
+func (r *Room) broadcastFrame(senderConnID string, f *frameBuf) {
+	r.mu.Lock()
 	r.lastActivity = time.Now()
+	r.mu.Unlock()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var newline, records bool
+	for _, c := range r.clients {
+		if c.connID != senderConnID {
+			newline, records = newline || !c.records, records || c.records
+		}
+	}
+	f.prepare(newline, records)
 	for _, c := range r.clients {
 		if c.connID == senderConnID {
 			continue
 		}
-		select {
-		case c.send <- data:
-		default:
-			// Client's send buffer full — drop message
+		r.deliverFrame(c, f)
+	}
+}
+
+// SendTo delivers data only to the connections whose token peer ID is in
+// peerIDs (a peer ID may have several connections). The ID a client
+// announces in "from" is not used: a client could announce anyone's. It
+// returns the requested peer IDs that have no connection in the room.
+func (r *Room) SendTo(senderConnID string, peerIDs []string, data []byte) (missing []string) {
+	r.mu.Lock()
+	r.lastActivity = time.Now()
+	r.mu.Unlock()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	found := make(map[string]bool, len(peerIDs))
+	for _, id := range peerIDs {
+		found[id] = false
+	}
+
+	kind := packetKind(data)
+	for _, c := range r.clients {
+		id := c.tokenPeerID
+		if _, ok := found[id]; !ok {
+			continue
+		}
+		found[id] = true
+		if c.connID != senderConnID {
+			r.deliver(c, data, kind)
+		}
+	}
+
+	for _, id := range peerIDs {
+		if !found[id] {
+			missing = append(missing, id)
+			found[id] = true // report duplicates once
 		}
 	}
+	return missing
+}
+
+// Peers lists the peers in the room, one entry per peer ID even if a peer
+// has several connections.
+func (r *Room) Peers() []PeerInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	peers := make([]PeerInfo, 0, len(r.clients))
+	seen := make(map[string]bool, len(r.clients))
+	for _, c := range r.clients {
+		info := c.info()
+		if seen[info.PeerID] {
+			continue
+		}
+		seen[info.PeerID] = true
+		peers = append(peers, info)
+	}
+	return peers
+}
+
+// Get returns the client with the given connection ID, or nil.
+func (r *Room) Get(connID string) *Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.clients[connID]
+}
+
+// BytesRelayed returns the total bytes delivered to clients in this room.
+func (r *Room) BytesRelayed() uint64 {
+	return r.bytesRelayed.Load()
+}
+
+// Clients returns a snapshot of the room's clients.
+func (r *Room) Clients() []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	clients := make([]*Client, 0, len(r.clients))
+	for _, c := range r.clients {
+		clients = append(clients, c)
+	}
+	return clients
 }
 
 func (r *Room) CloseAll() {
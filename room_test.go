@@ -120,3 +120,53 @@ func TestRoom_LastActivity(t *testing.T) {
 		t.Error("LastActivity should be updated after Add")
 	}
 }
+
+func TestRoom_SendTo(t *testing.T) {
+	room := NewRoom("test-room")
+
+	c1 := &Client{peerID: "peer-1", tokenPeerID: "peer-1", connID: "conn-1", send: make(chan []byte, 10)}
+	c2 := &Client{peerID: "peer-2", tokenPeerID: "peer-2", connID: "conn-2", send: make(chan []byte, 10)}
+	c3 := &Client{peerID: "peer-3", tokenPeerID: "peer-3", connID: "conn-3", send: make(chan []byte, 10)}
+	c3b := &Client{peerID: "peer-3", tokenPeerID: "peer-3", connID: "conn-3b", send: make(chan []byte, 10)}
+	room.Add(c1)
+	room.Add(c2)
+	room.Add(c3)
+	room.Add(c3b)
+
+	missing := room.SendTo("conn-1", []string{"peer-3", "ghost", "ghost"}, []byte("secret"))
+
+	if len(missing) != 1 || missing[0] != "ghost" {
+		t.Errorf("missing = %v, want [ghost]", missing)
+	}
+	for _, c := range []*Client{c3, c3b} {
+		if len(c.send) != 1 {
+			t.Errorf("%s got %d messages, want 1", c.connID, len(c.send))
+		}
+	}
+	if len(c2.send) != 0 {
+		t.Error("peer-2 should not receive a message addressed to peer-3")
+	}
+	if len(c1.send) != 0 {
+		t.Error("sender should not receive its own message")
+	}
+}
+
+func TestRoom_SendTo_SpoofedFrom(t *testing.T) {
+	room := NewRoom("test-room")
+
+	victim := &Client{peerID: "peer-1", tokenPeerID: "peer-1", connID: "conn-1", send: make(chan []byte, 10)}
+	// The spoofer's token says peer-2, but it announced itself as peer-1.
+	spoofer := &Client{peerID: "peer-1", tokenPeerID: "peer-2", connID: "conn-2", send: make(chan []byte, 10)}
+	host := &Client{peerID: "host", tokenPeerID: "host", connID: "conn-host", send: make(chan []byte, 10)}
+	room.Add(victim)
+	room.Add(spoofer)
+	room.Add(host)
+
+	room.SendTo("conn-host", []string{"peer-1"}, []byte("key"))
+	if len(victim.send) != 1 {
+		t.Error("peer-1 did not receive its message")
+	}
+	if len(spoofer.send) != 0 {
+		t.Error("a peer announcing someone else's ID received their message")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -16,6 +17,7 @@ var upgrader = websocket.Upgrader{
 	ReadBufferSize:  65536,
 	WriteBufferSize: 65536,
 	CheckOrigin:     func(r *http.Request) bool { return true },
+	Subprotocols:    []string{subprotocolRecords, subprotocol},
 }
 
 type Server struct {
@@ -28,9 +30,14 @@ type Server struct {
 
 func NewServer(cfg *Config, hub *Hub) *Server {
 	s := &Server{
-		cfg:     cfg,
-		hub:     hub,
-		auth:    NewAuth(),
+		cfg: cfg,
+		hub: hub,
+		auth: &Auth{
+			ClockSkew:   cfg.JWTClockSkew,
+			MaxLifetime: cfg.JWTMaxLifetime,
+			Audience:    cfg.JWTAudience,
+			Issuer:      cfg.JWTIssuer,
+		},
 		limiter: NewRateLimiter(cfg.RateLimitPerIP),
 	}
 
@@ -51,15 +58,24 @@ func NewServer(cfg *Config, hub *Hub) *Server {
 }
 
 func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	if s.cfg.ProxyProtocol {
+		log.Println("PROXY protocol enabled")
+		ln = newProxyProtoListener(ln, s.cfg.TrustedProxies)
+	}
+
 	if s.cfg.TLSCert != "" && s.cfg.TLSKey != "" {
 		s.srv.TLSConfig = &tls.Config{
 			MinVersion: tls.VersionTLS13,
 		}
 		log.Printf("TLS enabled (cert=%s)", s.cfg.TLSCert)
-		return s.srv.ListenAndServeTLS(s.cfg.TLSCert, s.cfg.TLSKey)
+		return s.srv.ServeTLS(ln, s.cfg.TLSCert, s.cfg.TLSKey)
 	}
 	log.Println("TLS disabled (no cert/key configured)")
-	return s.srv.ListenAndServe()
+	return s.srv.Serve(ln)
 }
 
 func (s *Server) Shutdown() {
@@ -77,98 +93,235 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
-	ip := clientIP(r)
+	ip := clientIP(r, s.cfg.TrustedProxies)
 
 	if !s.limiter.Allow(ip) {
-		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		s.reject(w, &rejection{"rate_limited", "rate limit exceeded", http.StatusTooManyRequests})
+		return
+	}
+
+	q := r.URL.Query()
+	token, authMethod := s.requestToken(r)
+	req := &joinRequest{
+		RoomID: q.Get("room"),
+		Token:  token,
+		Pubkey: q.Get("pubkey"),
+		Rotate: q.Get("rotate"),
+		Resume: q.Get("resume"),
+	}
+
+	if s.cfg.PostUpgradeAuth && authMethod == "" && req.RoomID == "" {
+		s.serveAuthMessage(w, r, ip)
+		return
+	}
+	if token == "" && authMethod == authMethodQuery {
+		s.reject(w, &rejection{"query_token_disabled", "send the token in the Authorization header or Sec-WebSocket-Protocol", http.StatusUnauthorized})
+		return
+	}
+	if req.RoomID == "" || req.Token == "" {
+		s.reject(w, &rejection{"missing_params", "missing room or token", http.StatusBadRequest})
+		return
+	}
+
+	if s.redirectToOwner(w, r, req.RoomID) {
 		return
 	}
 
-	roomID := r.URL.Query().Get("room")
-	token := r.URL.Query().Get("token")
-	pubkey := r.URL.Query().Get("pubkey")
+	claims, rej := s.admit(req, ip)
+	if rej != nil {
+		s.reject(w, rej)
+		return
+	}
 
-	if roomID == "" || token == "" {
-		http.Error(w, "missing room or token", http.StatusBadRequest)
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("upgrade error: %v", err)
 		return
 	}
+	metrics.AuthMethods.Inc(authMethod)
+	s.join(conn, req, claims, ip)
+}
+
+// joinRequest is what a client presents to join a room, whether in the
+// handshake or in a post-upgrade auth message.
+type joinRequest struct {
+	RoomID string `json:"room"`
+	Token  string `json:"token"`
+	Pubkey string `json:"pubkey,omitempty"` // host only
+	Rotate string `json:"rotate,omitempty"` // host key rotation signature
+	Resume string `json:"resume,omitempty"` // resumption token
+}
+
+// rejection is a refused join: the metrics reason, a message safe to show
+// the client, and the HTTP status used before the upgrade.
+type rejection struct {
+	reason string
+	msg    string
+	status int
+}
+
+// closeCode is the close code for a rejection after the upgrade: 1013 (try
+// again later) for capacity problems, 1008 for everything else.
+func (rej *rejection) closeCode() int {
+	if rej.status == http.StatusServiceUnavailable {
+		return websocket.CloseTryAgainLater
+	}
+	return websocket.ClosePolicyViolation
+}
+
+// admit authenticates req and checks room policy. It registers or rotates
+// the host key as a side effect and spends single-use invites, so it must
+// only be called once the connection is about to join.
+func (s *Server) admit(req *joinRequest, ip string) (*Claims, *rejection) {
+	roomID := req.RoomID
 
 	// Host provides pubkey to register; guests don't
-	isHost := pubkey != ""
+	isHost := req.Pubkey != ""
 
 	var claims *Claims
 	var err error
 
 	if isHost {
-		hostPubKey, decErr := base64.RawURLEncoding.DecodeString(pubkey)
+		hostPubKey, decErr := base64.RawURLEncoding.DecodeString(req.Pubkey)
 		if decErr != nil || len(hostPubKey) != 32 {
-			http.Error(w, "invalid pubkey", http.StatusBadRequest)
-			return
+			return nil, &rejection{"invalid_pubkey", "invalid pubkey", http.StatusBadRequest}
 		}
-		claims, err = s.auth.ValidateJWT(token, hostPubKey)
+		claims, err = s.auth.ValidateJWT(req.Token, hostPubKey)
 		if err != nil {
-			http.Error(w, "invalid token: "+err.Error(), http.StatusUnauthorized)
-			return
+			return nil, tokenRejection(ip, err)
 		}
 		if claims.RoomID != roomID {
-			http.Error(w, "room mismatch", http.StatusForbidden)
-			return
+			return nil, &rejection{"room_mismatch", "room mismatch", http.StatusForbidden}
+		}
+		if s.hub.Draining() && s.hub.ClientCount(roomID) == 0 {
+			return nil, &rejection{"draining", "relay is draining; no new rooms", http.StatusServiceUnavailable}
+		}
+		if s.hub.RoomCount() >= s.cfg.MaxRooms {
+			return nil, &rejection{"max_rooms", "max rooms reached", http.StatusServiceUnavailable}
+		}
+		if req.Rotate != "" {
+			sig, decErr := base64.RawURLEncoding.DecodeString(req.Rotate)
+			if decErr != nil {
+				return nil, &rejection{"invalid_rotation", "invalid rotation signature", http.StatusBadRequest}
+			}
+			err = s.hub.RotateHostKey(roomID, hostPubKey, sig)
+		} else {
+			err = s.hub.RegisterHostKey(roomID, hostPubKey)
+		}
+		if errors.Is(err, ErrHostKeyConflict) {
+			log.Printf("host key conflict for room %s from %s", roomID, ip)
+			return nil, &rejection{"host_key_conflict", "room is bound to a different host key", http.StatusConflict}
+		}
+		if err != nil {
+			log.Printf("host key rotation rejected for room %s from %s", roomID, ip)
+			return nil, &rejection{"invalid_rotation", "invalid rotation signature", http.StatusForbidden}
+		}
+		if claims.MaxPeers > 0 {
+			s.hub.SetRoomLimit(roomID, claims.MaxPeers)
+		}
+		if claims.Lobby {
+			s.hub.SetLobby(roomID)
+		}
+		if claims.SlowConsumer != "" {
+			s.hub.SetSlowConsumer(roomID, claims.SlowConsumer)
 		}
-		s.hub.RegisterHostKey(roomID, hostPubKey)
 	} else {
 		hostKey := s.hub.GetHostKey(roomID)
 		if hostKey == nil {
-			http.Error(w, "room not found", http.StatusNotFound)
-			return
+			return nil, &rejection{"room_not_found", "room not found", http.StatusNotFound}
 		}
-		claims, err = s.auth.ValidateJWT(token, hostKey)
+		claims, err = s.auth.ValidateJWT(req.Token, hostKey)
 		if err != nil {
-			http.Error(w, "invalid token: "+err.Error(), http.StatusUnauthorized)
-			return
+			return nil, tokenRejection(ip, err)
 		}
 		if claims.RoomID != roomID {
-			http.Error(w, "room mismatch", http.StatusForbidden)
-			return
+			return nil, &rejection{"room_mismatch", "room mismatch", http.StatusForbidden}
+		}
+		if s.hub.Revoked(roomID, claims) {
+			return nil, &rejection{"token_revoked", "token revoked", http.StatusForbidden}
 		}
 	}
 
-	if isHost {
-		if s.hub.RoomCount() >= s.cfg.MaxRooms {
-			http.Error(w, "max rooms reached", http.StatusServiceUnavailable)
-			return
-		}
-	} else {
-		if count := s.hub.ClientCount(roomID); count >= s.cfg.MaxClientsPerRoom {
-			http.Error(w, "room full", http.StatusServiceUnavailable)
-			return
-		}
+	// A resuming client takes over its old slot, so it is not subject to the
+	// room-size check. A token that resumes nothing for this peer is
+	// dropped, so the request is admitted, and joined, as a fresh one.
+	if req.Resume != "" && !s.hub.CanResume(req.Resume, roomID, claims.PeerID) {
+		metrics.Resumptions.Inc("fallback")
+		req.Resume = ""
 	}
+	resuming := req.Resume != ""
 
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("upgrade error: %v", err)
-		return
+	if !isHost && !resuming && s.hub.HostAway(roomID) {
+		return nil, &rejection{"host_away", "waiting for the host to return", http.StatusServiceUnavailable}
 	}
 
-	// Set generous read limit. Messages within MaxMessageSize are forwarded normally.
-	// gorilla/websocket closes connection on exceeding ReadLimit, so set it high (50MB)
-	// to prevent accidental disconnects. Client-side safety net drops messages > 8MB.
-	conn.SetReadLimit(50 * 1024 * 1024)
+	if !isHost && !resuming {
+		if s.hub.Locked(roomID) {
+			return nil, &rejection{"room_locked", "room locked", http.StatusForbidden}
+		}
+		if count := s.hub.ClientCount(roomID); count >= s.hub.RoomLimit(roomID) {
+			return nil, &rejection{"room_full", "room full", http.StatusServiceUnavailable}
+		}
+		// Spend a single-use invite only once the join is otherwise certain,
+		// so a full room does not burn it. Resuming reuses the spent token.
+		if claims.JTI != "" && !s.hub.ConsumeJTI(roomID, claims) {
+			return nil, &rejection{"token_reused", "token already used", http.StatusForbidden}
+		}
+	}
 
-	client := NewClient(s.hub, conn, roomID, claims.PeerID, claims.Role, ip)
-	s.hub.Register(client)
+	return claims, nil
 }
 
-func clientIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		return xff
-	}
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+// join hands an admitted connection to the hub.
+func (s *Server) join(conn *websocket.Conn, req *joinRequest, claims *Claims, ip string) {
+	// Per-message voice/data limits are enforced in Client.readMessage; this is
+	// the hard ceiling past which gorilla itself closes with 1009.
+	conn.SetReadLimit(connReadLimit(s.cfg))
+
+	client := NewClient(s.hub, conn, req.RoomID, claims.PeerID, claims.Role, claims.Name, ip)
+	client.applyClaims(claims)
+	client.records = conn.Subprotocol() == subprotocolRecords
+	metrics.Framing.Inc(client.framing())
+	switch {
+	case req.Resume != "":
+		s.hub.Resume(client, req.Resume)
+	case claims.Role != "host" && s.hub.Lobby(req.RoomID):
+		s.hub.Wait(client)
+	default:
+		s.hub.Register(client)
 	}
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
+}
+
+// tokenRejections maps token validation errors to handshake rejection
+// reasons. The response names the failed check but never echoes the claim
+// values or the relay's expected ones.
+var tokenRejections = []struct {
+	err    error
+	reason string
+	msg    string
+}{
+	{ErrTokenExpired, "token_expired", "token expired"},
+	{ErrTokenNotYetValid, "token_not_yet_valid", "token not yet valid"},
+	{ErrTokenLifetime, "token_lifetime", "token lifetime too long"},
+	{ErrTokenAudience, "token_audience", "token not valid for this relay"},
+	{ErrTokenIssuer, "token_issuer", "token issuer not accepted"},
+	{ErrTokenClaims, "invalid_claims", "invalid token claims"},
+}
+
+// tokenRejection describes a token that did not validate. Signature and
+// format failures share one code so probing reveals nothing about the key.
+func tokenRejection(ip string, err error) *rejection {
+	log.Printf("token rejected from %s: %v", ip, err)
+	for _, tr := range tokenRejections {
+		if errors.Is(err, tr.err) {
+			return &rejection{tr.reason, tr.msg, http.StatusUnauthorized}
+		}
 	}
-	return host
+	return &rejection{"invalid_token", "invalid token", http.StatusUnauthorized}
+}
+
+// reject fails a WebSocket handshake and records the reason in metrics.
+func (s *Server) reject(w http.ResponseWriter, rej *rejection) {
+	metrics.HandshakeRejections.Inc(rej.reason)
+	http.Error(w, rej.msg, rej.status)
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func hostToken(t testing.TB, roomID string) (pub ed25519.PublicKey, priv ed25519.PrivateKey, token string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token = SignJWT(&Claims{
+		RoomID:    roomID,
+		PeerID:    "host-1",
+		Role:      "host",
+		CreatedAt: time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}, priv)
+	return pub, priv, token
+}
+
+func TestHandleWS_HostKeyConflict(t *testing.T) {
+	hub := NewHub(testConfig())
+	srv := NewServer(testConfig(), hub)
+
+	owner, _, _ := hostToken(t, "room-1")
+	_ = hub.RegisterHostKey("room-1", owner)
+
+	attackerPub, _, attackerToken := hostToken(t, "room-1")
+	q := url.Values{
+		"room":   {"room-1"},
+		"token":  {attackerToken},
+		"pubkey": {base64.RawURLEncoding.EncodeToString(attackerPub)},
+	}
+
+	before := metrics.HandshakeRejections.Value("host_key_conflict")
+	rec := httptest.NewRecorder()
+	srv.handleWS(rec, httptest.NewRequest("GET", "/ws?"+q.Encode(), nil))
+
+	if rec.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if got := metrics.HandshakeRejections.Value("host_key_conflict") - before; got != 1 {
+		t.Errorf("host_key_conflict rejections = %d, want 1", got)
+	}
+	if string(hub.GetHostKey("room-1")) != string(owner) {
+		t.Error("attacker replaced the pinned host key")
+	}
+}
+
+// testRelay runs a full relay (hub + HTTP handlers) for integration tests.
+type testRelay struct {
+	hub *Hub
+	srv *Server
+	url string
+}
+
+func newTestRelay(t testing.TB, cfg *Config) *testRelay {
+	t.Helper()
+	return serveTestRelay(t, cfg, NewHub(cfg))
+}
+
+// serveTestRelay runs hub, which may already be attached to a backplane.
+func serveTestRelay(t testing.TB, cfg *Config, hub *Hub) *testRelay {
+	t.Helper()
+	srv := NewServer(cfg, hub)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go hub.Run(ctx)
+	t.Cleanup(cancel)
+
+	ts := httptest.NewServer(srv.srv.Handler)
+	t.Cleanup(ts.Close)
+
+	return &testRelay{hub: hub, srv: srv, url: "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"}
+}
+
+func (tr *testRelay) dial(t testing.TB, q url.Values) *websocket.Conn {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(tr.url+"?"+q.Encode(), nil)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("dial: %v (status %d)", err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readEnvelope reads messages until one of the given type arrives. Data
+// messages may arrive newline-batched, so each line is inspected.
+func readEnvelope(t testing.TB, conn *websocket.Conn, typ string) map[string]any {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		for _, line := range strings.Split(string(msg), "\n") {
+			var env map[string]any
+			if json.Unmarshal([]byte(line), &env) == nil && env["type"] == typ {
+				return env
+			}
+		}
+	}
+}
+
+func guestToken(priv ed25519.PrivateKey, roomID, peerID string) string {
+	return SignJWT(&Claims{
+		RoomID:    roomID,
+		PeerID:    peerID,
+		Role:      "guest",
+		CreatedAt: time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}, priv)
+}
+
+func TestHandleWS_JoinAndRoster(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+
+	pub, priv, _ := hostToken(t, "room-1")
+	hostJWT := SignJWT(&Claims{
+		RoomID:    "room-1",
+		PeerID:    "host-1",
+		Role:      "host",
+		Name:      "Alice \"the host\"",
+		CreatedAt: time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}, priv)
+	host := tr.dial(t, url.Values{
+		"room":   {"room-1"},
+		"token":  {hostJWT},
+		"pubkey": {base64.RawURLEncoding.EncodeToString(pub)},
+	})
+	first := readEnvelope(t, host, "session:roster")
+	if peers := first["payload"].(map[string]any)["peers"].([]any); len(peers) != 0 {
+		t.Errorf("first peer's roster = %v, want empty", peers)
+	}
+
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+
+	roster := readEnvelope(t, guest, "session:roster")
+	peers := roster["payload"].(map[string]any)["peers"].([]any)
+	if len(peers) != 1 {
+		t.Fatalf("roster = %v, want the host only", peers)
+	}
+	hostInfo := peers[0].(map[string]any)
+	if hostInfo["peer_id"] != "host-1" || hostInfo["role"] != "host" || hostInfo["name"] != `Alice "the host"` {
+		t.Errorf("roster entry = %v", hostInfo)
+	}
+
+	join := readEnvelope(t, host, "session:join")
+	if join["from"] != "guest-1" {
+		t.Errorf("join from %v, want guest-1", join["from"])
+	}
+	if join["payload"].(map[string]any)["role"] != "guest" {
+		t.Errorf("join payload = %v", join["payload"])
+	}
+}
+
+func TestHandleWS_TokenRejectionCodes(t *testing.T) {
+	cfg := testConfig()
+	cfg.JWTMaxLifetime = time.Hour
+	hub := NewHub(cfg)
+	srv := NewServer(cfg, hub)
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_ = hub.RegisterHostKey("room-1", pub)
+
+	expired := SignJWT(&Claims{
+		RoomID:    "room-1",
+		PeerID:    "guest-1",
+		Role:      "guest",
+		CreatedAt: time.Now().Add(-2 * time.Hour).Unix(),
+		ExpiresAt: time.Now().Add(-time.Hour).Unix(),
+	}, priv)
+	forever := SignJWT(&Claims{RoomID: "room-1", PeerID: "guest-1", Role: "guest"}, priv)
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		token  string
+		reason string
+	}{
+		{expired, "token_expired"},
+		{forever, "token_lifetime"},
+		{guestToken(otherPriv, "room-1", "guest-1"), "invalid_token"},
+	}
+	for _, tt := range tests {
+		before := metrics.HandshakeRejections.Value(tt.reason)
+		q := url.Values{"room": {"room-1"}, "token": {tt.token}}
+		rec := httptest.NewRecorder()
+		srv.handleWS(rec, httptest.NewRequest("GET", "/ws?"+q.Encode(), nil))
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want 401", tt.reason, rec.Code)
+		}
+		if got := metrics.HandshakeRejections.Value(tt.reason) - before; got != 1 {
+			t.Errorf("%s rejections = %d, want 1", tt.reason, got)
+		}
+		// Validation detail (claim values, key errors) goes to the log only.
+		if body := rec.Body.String(); strings.Contains(body, ":") {
+			t.Errorf("%s: response leaks detail: %q", tt.reason, body)
+		}
+	}
+}
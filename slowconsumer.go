@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+)
+
+// Slow-consumer policies: what a room does when one of a peer's send queues
+// is full.
+const (
+	slowConsumerDrop       = "drop"       // drop the message; tell the peer with relay:overflow
+	slowConsumerDisconnect = "disconnect" // close the peer with closeSlowConsumer
+	slowConsumerDropVoice  = "drop_voice" // evict the oldest queued voice frame; close the peer rather than drop data
+)
+
+// closeSlowConsumer is the close code for a peer that could not keep up with
+// its room.
+const closeSlowConsumer = 4008
+
+// Overflow is the payload of relay:overflow, sent to a peer once its queue
+// has room again: it missed Dropped messages and should resync.
+type Overflow struct {
+	Dropped int64 `json:"dropped"`
+}
+
+func validSlowConsumerPolicy(p string) bool {
+	return p == slowConsumerDrop || p == slowConsumerDisconnect || p == slowConsumerDropVoice
+}
+
+// SetSlowConsumer sets roomID's slow-consumer policy, overriding the relay's
+// default.
+func (h *Hub) SetSlowConsumer(roomID, policy string) {
+	h.mu.Lock()
+	m := h.moderationFor(roomID)
+	was := m.slowConsumer
+	m.slowConsumer = policy
+	if room := h.rooms[roomID]; room != nil {
+		room.setSlowConsumer(policy)
+	}
+	h.mu.Unlock()
+
+	if was != policy {
+		h.publish(&ClusterEvent{Type: clusterModerate, RoomID: roomID, Control: "slow_consumer", Moderation: &ModerationCommand{Policy: policy}})
+	}
+}
+
+// slowConsumerFor returns roomID's slow-consumer policy. The caller must
+// hold h.mu.
+func (h *Hub) slowConsumerFor(roomID string) string {
+	if m, ok := h.moderation[roomID]; ok && m.slowConsumer != "" {
+		return m.slowConsumer
+	}
+	return h.cfg.SlowConsumerPolicy
+}
+
+func (r *Room) setSlowConsumer(policy string) {
+	r.mu.Lock()
+	r.slowConsumer = policy
+	r.mu.Unlock()
+}
+
+// deliver queues data for c, applying the room's slow-consumer policy if c's
+// queue is full. The caller holds r.mu.
+func (r *Room) deliver(c *Client, data []byte, kind string) {
+	if isVoicePacket(data) {
+		f := frameOf(data)
+		r.deliverFrame(c, f)
+		f.release()
+		return
+	}
+	r.notifyOverflow(c)
+	if c.trySend(data) {
+		r.relayed(data, kind)
+		return
+	}
+
+	metrics.SendsDropped.Inc(kind)
+	switch r.slowConsumer {
+	case slowConsumerDisconnect, slowConsumerDropVoice:
+		c.dropSlow()
+	default:
+		c.overflow.Add(1)
+	}
+}
+
+// deliverFrame is deliver for a voice frame.
+func (r *Room) deliverFrame(c *Client, f *frameBuf) {
+	r.notifyOverflow(c)
+	if c.queueVoice(f) || (r.slowConsumer == slowConsumerDropVoice && c.evictOldestVoice(f)) {
+		r.relayed(f.b, "voice")
+		return
+	}
+
+	metrics.SendsDropped.Inc("voice")
+	switch r.slowConsumer {
+	case slowConsumerDisconnect:
+		c.dropSlow()
+	case slowConsumerDropVoice:
+		// Voice could not be queued even after an eviction; it is dropped.
+	default:
+		c.overflow.Add(1)
+	}
+}
+
+// notifyOverflow tells a peer that lost messages about it, before anything
+// newer.
+func (r *Room) notifyOverflow(c *Client) {
+	if n := c.overflow.Load(); n > 0 && c.trySend(newEnvelope("relay:overflow", relayPeerID, &Overflow{Dropped: n})) {
+		c.overflow.Add(-n)
+	}
+}
+
+func (r *Room) relayed(data []byte, kind string) {
+	r.bytesRelayed.Add(uint64(len(data)))
+	metrics.MessagesRelayed.Inc(kind)
+	metrics.BytesRelayed.Add(uint64(len(data)), kind)
+}
+
+// evictOldestVoice makes room for the voice frame f by dropping the oldest
+// frame in c's voice queue. It returns false, and queues nothing, if there
+// is nothing to evict.
+func (c *Client) evictOldestVoice(f *frameBuf) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.detached {
+		return false
+	}
+	select {
+	case old := <-c.voice:
+		c.voiceBytes.Add(-int64(len(old.b)))
+		old.release()
+	default:
+		return false
+	}
+	if !c.queueVoiceLocked(f) {
+		return false
+	}
+	metrics.SlowConsumerActions.Inc("voice_evicted")
+	return true
+}
+
+// dropSlow closes a peer that cannot keep up. The close frame is written from
+// another goroutine so the room's shard never waits on a stalled connection.
+func (c *Client) dropSlow() {
+	c.mu.Lock()
+	if c.kicked || c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.kicked = true
+	c.mu.Unlock()
+
+	metrics.SlowConsumerActions.Inc("disconnect")
+	log.Printf("closing peer=%s room=%s: slow consumer", c.PeerID(), c.roomID)
+	go c.Kick(closeSlowConsumer, "slow consumer")
+}
+
+// writeQueueDepths renders the depth of both queues of every local
+// connection, in messages and bytes.
+func writeQueueDepths(w io.Writer, hub *Hub) {
+	const name, bytesName = "relay_client_queue_depth", "relay_client_queue_bytes"
+
+	hub.mu.RLock()
+	rooms := make([]*Room, 0, len(hub.rooms))
+	for _, room := range hub.rooms {
+		rooms = append(rooms, room)
+	}
+	hub.mu.RUnlock()
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].id < rooms[j].id })
+
+	var clients [][]*Client
+	for _, room := range rooms {
+		cs := room.Clients()
+		sort.Slice(cs, func(i, j int) bool { return cs[i].connID < cs[j].connID })
+		clients = append(clients, cs)
+	}
+
+	labels := []string{"room", "conn_id", "queue"}
+	fmt.Fprintf(w, "# HELP %s Messages waiting in each connection's send queues.\n# TYPE %s gauge\n", name, name)
+	for i, room := range rooms {
+		for _, c := range clients[i] {
+			fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(labels, []string{room.id, c.connID, "data"}), len(c.send))
+			fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(labels, []string{room.id, c.connID, "voice"}), len(c.voice))
+		}
+	}
+	fmt.Fprintf(w, "# HELP %s Bytes waiting in each connection's send queues.\n# TYPE %s gauge\n", bytesName, bytesName)
+	for i, room := range rooms {
+		for _, c := range clients[i] {
+			fmt.Fprintf(w, "%s%s %d\n", bytesName, formatLabels(labels, []string{room.id, c.connID, "data"}), c.dataBytes.Load())
+			fmt.Fprintf(w, "%s%s %d\n", bytesName, formatLabels(labels, []string{room.id, c.connID, "voice"}), c.voiceBytes.Load())
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRoom_SlowConsumerDrop(t *testing.T) {
+	room := NewRoom("room-1")
+	room.slowConsumer = slowConsumerDrop
+	slow := &Client{peerID: "peer-1", connID: "conn-1", send: make(chan []byte, 2)}
+	room.Add(slow)
+
+	for _, msg := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		room.Broadcast("", []byte(msg))
+	}
+	<-slow.send
+	<-slow.send
+
+	room.Broadcast("", []byte(`{"n":4}`))
+	var env struct {
+		Type    string   `json:"type"`
+		Payload Overflow `json:"payload"`
+	}
+	if err := json.Unmarshal(<-slow.send, &env); err != nil || env.Type != "relay:overflow" || env.Payload.Dropped != 1 {
+		t.Fatalf("first message = %+v, %v; want relay:overflow with dropped=1", env, err)
+	}
+	if got := string(<-slow.send); got != `{"n":4}` {
+		t.Errorf("second message = %s", got)
+	}
+	if n := slow.overflow.Load(); n != 0 {
+		t.Errorf("overflow = %d after the notice", n)
+	}
+}
+
+func TestRoom_SlowConsumerDropVoice(t *testing.T) {
+	room := NewRoom("room-1")
+	room.slowConsumer = slowConsumerDropVoice
+	slow := &Client{peerID: "peer-1", connID: "conn-1", send: make(chan []byte, 1), voice: make(chan *frameBuf, 2)}
+	room.Add(slow)
+
+	voice1 := []byte{voiceMagic0, voiceMagic1, 1}
+	voice2 := []byte{voiceMagic0, voiceMagic1, 2}
+	voice3 := []byte{voiceMagic0, voiceMagic1, 3}
+	room.Broadcast("", voice1)
+	room.Broadcast("", []byte(`{"n":1}`))
+	room.Broadcast("", voice2)
+
+	before := metrics.SlowConsumerActions.Value("voice_evicted")
+	room.Broadcast("", voice3)
+	if got := metrics.SlowConsumerActions.Value("voice_evicted") - before; got != 1 {
+		t.Errorf("voice_evicted = %d, want 1", got)
+	}
+
+	for i, w := range [][]byte{voice2, voice3} {
+		if got := <-slow.voice; !bytes.Equal(got.b, w) {
+			t.Errorf("voice frame %d = %v, want %v", i, got.b, w)
+		}
+	}
+	if got := string(<-slow.send); got != `{"n":1}` {
+		t.Errorf("data = %q, want {\"n\":1}", got)
+	}
+}
+
+func TestHandleWS_SlowConsumerDisconnect(t *testing.T) {
+	// Under drop_voice, data is never dropped either: a full data queue
+	// closes the peer just as it does under disconnect.
+	for _, policy := range []string{slowConsumerDisconnect, slowConsumerDropVoice} {
+		t.Run(policy, func(t *testing.T) {
+			testSlowConsumerDisconnect(t, policy)
+		})
+	}
+}
+
+func testSlowConsumerDisconnect(t *testing.T, policy string) {
+	cfg := testConfig()
+	cfg.SlowConsumerPolicy = policy
+	tr := newTestRelay(t, cfg)
+	host, priv := joinAsHost(t, tr, "room-1")
+	slow := tr.dial(t, url.Values{"room": {"room-1"}, "token": {guestToken(priv, "room-1", "guest-1")}})
+	readEnvelope(t, host, "session:join")
+
+	// The guest stops reading; the host keeps sending until the relay gives
+	// up on the guest.
+	before := metrics.SlowConsumerActions.Value("disconnect")
+	chunk := make([]byte, 64<<10)
+	deadline := time.Now().Add(10 * time.Second)
+	for metrics.SlowConsumerActions.Value("disconnect") == before {
+		if time.Now().After(deadline) {
+			t.Fatal("slow consumer was never disconnected")
+		}
+		if err := host.WriteMessage(websocket.BinaryMessage, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_ = slow.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		if _, _, err := slow.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, closeSlowConsumer) {
+				t.Errorf("expected close %d, got %v", closeSlowConsumer, err)
+			}
+			break
+		}
+	}
+}
+
+func TestHandleWS_InvalidSlowConsumerLeavesNoTrace(t *testing.T) {
+	cfg := testConfig()
+	hub := NewHub(cfg)
+	srv := NewServer(cfg, hub)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := SignJWT(&Claims{
+		RoomID:       "room-1",
+		PeerID:       "host-1",
+		Role:         "host",
+		MaxPeers:     3,
+		Lobby:        true,
+		SlowConsumer: "bogus",
+		CreatedAt:    time.Now().Unix(),
+		ExpiresAt:    time.Now().Add(time.Hour).Unix(),
+	}, priv)
+	q := url.Values{"room": {"room-1"}, "token": {token}, "pubkey": {base64.RawURLEncoding.EncodeToString(pub)}}
+	rec := httptest.NewRecorder()
+	srv.handleWS(rec, httptest.NewRequest("GET", "/ws?"+q.Encode(), nil))
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rec.Code)
+	}
+	// The token is refused before it can pin a key or shape the room.
+	if hub.GetHostKey("room-1") != nil {
+		t.Error("refused host token pinned its key")
+	}
+	if hub.RoomLimit("room-1") != cfg.MaxClientsPerRoom {
+		t.Errorf("room limit = %d, want the relay default", hub.RoomLimit("room-1"))
+	}
+	if hub.Lobby("room-1") {
+		t.Error("refused host token enabled the lobby")
+	}
+}
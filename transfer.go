@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"slices"
+)
+
+// Chunked transfers. A peer sharing a large payload sends a transfer:begin
+// envelope, a run of binary chunk frames and a transfer:end envelope. The
+// relay forwards chunks as a stream, never reassembling the payload, and
+// paces each recipient with credit of its own: it gets the chunks numbered
+// below its transfer:ack plus TransferWindow. The chunks past that are held
+// for it, so a slow recipient is paused without stalling the others. The
+// sender may send the chunks numbered below the limit in the last
+// transfer:credit, which trails the fastest recipient by TransferWindow
+// chunks, and the slowest by twice that, so the relay never holds more than
+// a window of chunks for a recipient.
+//
+// A chunk frame is the magic bytes "KT", the transfer ID's length (one
+// byte), the transfer ID, the chunk's sequence number (uint32, big-endian,
+// starting at 0) and the chunk data.
+
+// chunkMagic1 follows voiceMagic0 in a chunk frame (0x4B54 = "KT").
+const chunkMagic1 = 0x54
+
+// chunkHeaderMax is the longest possible chunk header.
+const chunkHeaderMax = 2 + 1 + 255 + 4
+
+// transferMaxPerPeer bounds the transfers a connection may have in flight.
+const transferMaxPerPeer = 8
+
+// transferTypePrefix marks the envelopes the relay tracks transfers by.
+var transferTypePrefix = []byte(`"transfer:`)
+
+// TransferCredit is the payload of transfer:credit, sent to the sender: it
+// may send the chunks numbered below Limit.
+type TransferCredit struct {
+	ID    string `json:"id"`
+	Limit uint32 `json:"limit"`
+}
+
+// TransferAbort is the payload of the transfer:abort the relay sends when it
+// gives up on a transfer.
+type TransferAbort struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// transferEnvelope is the part of a transfer envelope the relay reads.
+// Received is set on transfer:ack: the number of chunks the recipient has
+// taken in.
+type transferEnvelope struct {
+	Type    string   `json:"type"`
+	To      peerList `json:"to"`
+	Payload struct {
+		ID       string `json:"id"`
+		Received uint32 `json:"received"`
+	} `json:"payload"`
+}
+
+// transfer is a chunked transfer in flight, keyed in its room by
+// transferKey. Peers are held by connection ID so a resumed connection keeps
+// its place. It is only used on the room's shard.
+type transfer struct {
+	id         string
+	sender     string // sender's conn ID
+	senderPeer string // sender's token peer ID, which acks may name in "to"
+	next       uint32 // sequence number of the next chunk
+	limit      uint32 // credit granted to the sender
+	ended      bool   // transfer:end is in; only held frames are left
+	recipients map[string]*transferRecipient
+}
+
+// transferRecipient is a recipient's progress through a transfer.
+type transferRecipient struct {
+	acked uint32   // chunks acknowledged
+	held  [][]byte // frames waiting for credit, oldest first
+}
+
+// transferKey scopes a transfer ID to its sender's connection, so peers
+// cannot collide with, or take over, each other's transfers.
+func transferKey(connID, id string) string {
+	return connID + "\x00" + id
+}
+
+// isTransferChunk reports whether data starts with the chunk magic bytes.
+func isTransferChunk(data []byte) bool {
+	return len(data) >= 2 && data[0] == voiceMagic0 && data[1] == chunkMagic1
+}
+
+// parseChunk splits a chunk frame into its transfer ID and sequence number.
+func parseChunk(data []byte) (id string, seq uint32, ok bool) {
+	if !isTransferChunk(data) || len(data) < 3 {
+		return "", 0, false
+	}
+	n := int(data[2])
+	if n == 0 || len(data) < 3+n+4 {
+		return "", 0, false
+	}
+	return string(data[3 : 3+n]), binary.BigEndian.Uint32(data[3+n:]), true
+}
+
+// parseTransferEnvelope decodes data if it is a transfer envelope. Only
+// messages mentioning a transfer: type are decoded.
+func parseTransferEnvelope(data []byte) (*transferEnvelope, bool) {
+	if !bytes.Contains(data, transferTypePrefix) {
+		return nil, false
+	}
+	var env transferEnvelope
+	if json.Unmarshal(data, &env) != nil || len(env.Type) <= 9 || env.Type[:9] != "transfer:" {
+		return nil, false
+	}
+	return &env, true
+}
+
+// isTransferAck reports whether data is a transfer:ack, which a peer may
+// send even if its token does not allow it to send messages.
+func isTransferAck(data []byte) bool {
+	env, ok := parseTransferEnvelope(data)
+	return ok && env.Type == "transfer:ack"
+}
+
+// relayTransfer handles a chunk frame or transfer envelope from a peer of
+// room. It reports false if data is neither, leaving it to the caller. It
+// runs on the room's shard.
+func (h *Hub) relayTransfer(room *Room, msg *BroadcastMsg) bool {
+	if isTransferChunk(msg.Data) {
+		if sender := room.Get(msg.SenderID); sender != nil {
+			h.transferChunk(room, sender, msg.Data)
+		}
+		return true
+	}
+	env, ok := parseTransferEnvelope(msg.Data)
+	if !ok {
+		return false
+	}
+	sender := room.Get(msg.SenderID)
+	if sender == nil {
+		return true
+	}
+
+	id := env.Payload.ID
+	switch env.Type {
+	case "transfer:begin":
+		h.beginTransfer(room, sender, env, msg.Data)
+	case "transfer:ack":
+		h.ackTransfer(room, sender, env)
+	case "transfer:end", "transfer:abort":
+		t := room.transfers[transferKey(sender.connID, id)]
+		if t == nil || t.ended {
+			sender.trySend(newRelayError(&RelayError{Code: "unknown_transfer", Message: "no transfer " + id + " in flight"}))
+			return true
+		}
+		if env.Type == "transfer:end" {
+			h.endTransfer(room, t, msg.Data)
+			metrics.TransferOutcomes.Inc("completed")
+		} else {
+			h.forwardTransfer(room, t, msg.Data)
+			delete(room.transfers, transferKey(t.sender, t.id))
+			metrics.TransferOutcomes.Inc("aborted")
+		}
+	default:
+		sender.trySend(newRelayError(&RelayError{Code: "invalid_transfer", Message: "unknown transfer message " + env.Type}))
+	}
+	return true
+}
+
+// beginTransfer registers a transfer and forwards its transfer:begin to the
+// recipients: the peers in the envelope's "to" field, or else the rest of
+// the room. Chunks are not carried over the cluster backplane, so a transfer
+// that would reach a peer on another node is refused. Like a directed
+// message, a "to" naming peers not in the room gets unknown_recipient.
+func (h *Hub) beginTransfer(room *Room, sender *Client, env *transferEnvelope, data []byte) {
+	id := env.Payload.ID
+	key := transferKey(sender.connID, id)
+	switch {
+	case id == "" || len(id) > 255:
+		sender.trySend(newRelayError(&RelayError{Code: "invalid_transfer", Message: "transfer id must be 1 to 255 bytes"}))
+		return
+	case room.transfers[key] != nil:
+		sender.trySend(newRelayError(&RelayError{Code: "transfer_in_use", Message: "transfer id " + id + " is already in flight"}))
+		return
+	case h.hasRemotePeer(room.id, env.To):
+		sender.trySend(newRelayError(&RelayError{Code: "transfer_remote_peer", Message: "transfers cannot reach peers on other relay nodes"}))
+		return
+	}
+	inFlight := 0
+	for _, t := range room.transfers {
+		if t.sender == sender.connID {
+			inFlight++
+		}
+	}
+	if inFlight >= transferMaxPerPeer {
+		sender.trySend(newRelayError(&RelayError{Code: "transfer_limit", Message: "too many transfers in flight"}))
+		return
+	}
+
+	t := &transfer{id: id, sender: sender.connID, senderPeer: sender.tokenPeerID, recipients: make(map[string]*transferRecipient)}
+	found := make(map[string]bool, len(env.To))
+	for _, c := range room.Clients() {
+		if len(env.To) > 0 && !slices.Contains(env.To, c.tokenPeerID) {
+			continue
+		}
+		found[c.tokenPeerID] = true
+		if c.connID != sender.connID {
+			t.recipients[c.connID] = &transferRecipient{}
+		}
+	}
+	var missing []string
+	for _, to := range env.To {
+		if !found[to] {
+			missing = append(missing, to)
+			found[to] = true // report duplicates once
+		}
+	}
+	if len(missing) > 0 {
+		sender.trySend(newRelayError(&RelayError{Code: "unknown_recipient", Message: "recipient not in room", Peers: missing}))
+		if len(missing) == len(env.To) {
+			return
+		}
+	}
+
+	room.transfers[key] = t
+	h.forwardTransfer(room, t, data)
+	h.grantCredit(room, t)
+}
+
+// ackTransfer records how far a recipient has got, releases the frames held
+// for it that are now within its credit, and passes any new credit on to the
+// sender. An ack names a transfer by its ID; if the recipient is receiving
+// several with that ID, its "to" names the sender.
+func (h *Hub) ackTransfer(room *Room, c *Client, env *transferEnvelope) {
+	for _, t := range room.transfers {
+		if t.id != env.Payload.ID || (len(env.To) > 0 && !slices.Contains(env.To, t.senderPeer)) {
+			continue
+		}
+		r, ok := t.recipients[c.connID]
+		if !ok || env.Payload.Received <= r.acked {
+			continue
+		}
+		r.acked = min(env.Payload.Received, t.next)
+		h.release(room, t, c.connID, r)
+		if t.ended && len(t.recipients) == 0 {
+			delete(room.transfers, transferKey(t.sender, t.id))
+			continue
+		}
+		h.grantCredit(room, t)
+	}
+}
+
+// transferChunk forwards a chunk once it has checked the chunk is the next
+// one of a transfer the sender owns and has credit for.
+func (h *Hub) transferChunk(room *Room, sender *Client, data []byte) {
+	id, seq, ok := parseChunk(data)
+	t := room.transfers[transferKey(sender.connID, id)]
+	if !ok || t == nil || t.ended {
+		sender.trySend(newRelayError(&RelayError{Code: "unknown_transfer", Message: "chunk for no transfer in flight"}))
+		return
+	}
+	switch {
+	case seq != t.next:
+		h.abortTransfer(room, t, "out_of_order")
+	case seq >= t.limit:
+		h.abortTransfer(room, t, "no_credit")
+	default:
+		t.next++
+		window := uint32(h.cfg.TransferWindow)
+		for connID, r := range t.recipients {
+			if len(r.held) > 0 || seq >= r.acked+window {
+				r.held = append(r.held, data)
+				continue
+			}
+			h.sendTransfer(room, t, connID, data)
+		}
+	}
+}
+
+// endTransfer forwards transfer:end. A recipient with frames still held gets
+// it after them, so the transfer stays in its room until they are released.
+func (h *Hub) endTransfer(room *Room, t *transfer, data []byte) {
+	t.ended = true
+	for connID, r := range t.recipients {
+		if len(r.held) > 0 {
+			r.held = append(r.held, data)
+			continue
+		}
+		if h.sendTransfer(room, t, connID, data) {
+			delete(t.recipients, connID)
+		}
+	}
+	if len(t.recipients) == 0 {
+		delete(room.transfers, transferKey(t.sender, t.id))
+	}
+}
+
+// release forwards the frames held for recipient connID that its credit now
+// covers. Once the last frame of an ended transfer is out, the recipient is
+// done with it.
+func (h *Hub) release(room *Room, t *transfer, connID string, r *transferRecipient) {
+	window := uint32(h.cfg.TransferWindow)
+	for len(r.held) > 0 {
+		if _, seq, ok := parseChunk(r.held[0]); ok && seq >= r.acked+window {
+			return
+		}
+		if !h.sendTransfer(room, t, connID, r.held[0]) {
+			return
+		}
+		r.held = r.held[1:]
+	}
+	if t.ended {
+		delete(t.recipients, connID)
+	}
+}
+
+// forwardTransfer queues a transfer frame for every recipient at once,
+// ahead of anything held for them.
+func (h *Hub) forwardTransfer(room *Room, t *transfer, data []byte) {
+	for connID := range t.recipients {
+		h.sendTransfer(room, t, connID, data)
+	}
+}
+
+// sendTransfer queues a transfer frame for recipient connID. A recipient that
+// has left is dropped from t; so is one whose queue is full, since it has
+// lost part of the transfer, and it is told to resync with relay:overflow.
+func (h *Hub) sendTransfer(room *Room, t *transfer, connID string, data []byte) bool {
+	c := room.Get(connID)
+	if c == nil {
+		delete(t.recipients, connID)
+		return false
+	}
+	kind := packetKind(data)
+	if !c.trySend(data) {
+		metrics.SendsDropped.Inc(kind)
+		c.overflow.Add(1)
+		delete(t.recipients, connID)
+		return false
+	}
+	room.bytesRelayed.Add(uint64(len(data)))
+	metrics.MessagesRelayed.Inc(kind)
+	metrics.BytesRelayed.Add(uint64(len(data)), kind)
+	return true
+}
+
+// grantCredit raises the sender's limit to TransferWindow chunks past what
+// the fastest recipient has acknowledged, but no further than twice that past
+// the slowest, which bounds the chunks held for it. With no recipient left,
+// the limit runs a window past the last chunk sent.
+func (h *Hub) grantCredit(room *Room, t *transfer) {
+	if t.ended {
+		return
+	}
+	window := uint32(h.cfg.TransferWindow)
+	limit := t.next + window
+	if len(t.recipients) > 0 {
+		fastest, slowest := uint32(0), t.next
+		for _, r := range t.recipients {
+			fastest, slowest = max(fastest, r.acked), min(slowest, r.acked)
+		}
+		limit = min(fastest+window, slowest+2*window)
+	}
+	if limit <= t.limit {
+		return
+	}
+	t.limit = limit
+	if sender := room.Get(t.sender); sender != nil {
+		sender.trySend(newEnvelope("transfer:credit", relayPeerID, &TransferCredit{ID: t.id, Limit: limit}))
+	}
+}
+
+// abortTransfer gives up on t, telling the sender and the recipients why.
+// Frames held for a recipient are discarded.
+func (h *Hub) abortTransfer(room *Room, t *transfer, reason string) {
+	abort := newEnvelope("transfer:abort", relayPeerID, &TransferAbort{ID: t.id, Reason: reason})
+	if sender := room.Get(t.sender); sender != nil {
+		sender.trySend(abort)
+	}
+	h.forwardTransfer(room, t, abort)
+	delete(room.transfers, transferKey(t.sender, t.id))
+	metrics.TransferOutcomes.Inc(reason)
+}
+
+// leaveTransfers removes a departing peer from room's transfers: those it
+// was sending are aborted, unless they have ended and only wait on held
+// frames, and those it was receiving no longer wait for it.
+func (h *Hub) leaveTransfers(room *Room, c *Client) {
+	for key, t := range room.transfers {
+		if t.sender == c.connID && !t.ended {
+			h.abortTransfer(room, t, "sender_left")
+			continue
+		}
+		if _, ok := t.recipients[c.connID]; ok {
+			delete(t.recipients, c.connID)
+			if t.ended && len(t.recipients) == 0 {
+				delete(room.transfers, key)
+				continue
+			}
+			h.grantCredit(room, t)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// chunkFrame builds a transfer chunk frame.
+func chunkFrame(id string, seq uint32, data []byte) []byte {
+	frame := append([]byte{voiceMagic0, chunkMagic1, byte(len(id))}, id...)
+	frame = binary.BigEndian.AppendUint32(frame, seq)
+	return append(frame, data...)
+}
+
+func transferMsg(typ, id string, received uint32) []byte {
+	return []byte(`{"type":"` + typ + `","from":"x","payload":{"id":"` + id + `","received":` + strconv.Itoa(int(received)) + `}}`)
+}
+
+// nextQueued returns the next message queued for c, failing if there is none.
+func nextQueued(t *testing.T, c *Client) []byte {
+	t.Helper()
+	select {
+	case msg := <-c.send:
+		return msg
+	default:
+		t.Fatalf("nothing queued for %s", c.peerID)
+		return nil
+	}
+}
+
+func expectCredit(t *testing.T, c *Client, limit uint32) {
+	t.Helper()
+	var env struct {
+		Type    string         `json:"type"`
+		Payload TransferCredit `json:"payload"`
+	}
+	msg := nextQueued(t, c)
+	if json.Unmarshal(msg, &env) != nil || env.Type != "transfer:credit" || env.Payload.Limit != limit {
+		t.Fatalf("got %s, want transfer:credit with limit %d", msg, limit)
+	}
+}
+
+func newTransferRoom(t *testing.T) (*Hub, *Client, *Client, *Client) {
+	t.Helper()
+	cfg := testConfig()
+	cfg.TransferWindow = 2
+	hub := NewHub(cfg)
+	room := NewRoom("room-1")
+	host := &Client{roomID: "room-1", peerID: "host", tokenPeerID: "host", connID: "conn-host", send: make(chan []byte, 16)}
+	g1 := &Client{roomID: "room-1", peerID: "guest-1", tokenPeerID: "guest-1", connID: "conn-g1", send: make(chan []byte, 16)}
+	g2 := &Client{roomID: "room-1", peerID: "guest-2", tokenPeerID: "guest-2", connID: "conn-g2", send: make(chan []byte, 16)}
+	room.Add(host)
+	room.Add(g1)
+	room.Add(g2)
+	hub.rooms["room-1"] = room
+	return hub, host, g1, g2
+}
+
+func TestHub_TransferCredit(t *testing.T) {
+	hub, host, g1, g2 := newTransferRoom(t)
+	send := func(from *Client, data []byte) {
+		hub.broadcast(&BroadcastMsg{RoomID: "room-1", SenderID: from.connID, Data: data})
+	}
+
+	send(host, transferMsg("transfer:begin", "t1", 0))
+	expectCredit(t, host, 2)
+	for _, g := range []*Client{g1, g2} {
+		if msg := nextQueued(t, g); !bytes.Contains(msg, []byte("transfer:begin")) {
+			t.Fatalf("%s got %s, want transfer:begin", g.peerID, msg)
+		}
+	}
+
+	// Chunks are forwarded unchanged and in order.
+	for seq := range uint32(2) {
+		send(host, chunkFrame("t1", seq, []byte{byte(seq)}))
+	}
+	for _, g := range []*Client{g1, g2} {
+		for seq := range uint32(2) {
+			if got, want := nextQueued(t, g), chunkFrame("t1", seq, []byte{byte(seq)}); !bytes.Equal(got, want) {
+				t.Errorf("%s chunk %d = %v, want %v", g.peerID, seq, got, want)
+			}
+		}
+	}
+
+	// Credit follows the fastest recipient.
+	send(g1, transferMsg("transfer:ack", "t1", 2))
+	expectCredit(t, host, 4)
+	send(g2, transferMsg("transfer:ack", "t1", 1))
+	if len(host.send) != 0 {
+		t.Fatal("credit granted for an ack behind the fastest recipient")
+	}
+
+	// Acks are for the relay; other peers never see them.
+	if len(g1.send)+len(g2.send) != 0 {
+		t.Error("transfer:ack was forwarded")
+	}
+
+	// guest-2's credit ends at chunk 3, which is held for it while guest-1
+	// carries on.
+	send(host, chunkFrame("t1", 2, nil))
+	send(host, chunkFrame("t1", 3, nil))
+	if msg := nextQueued(t, g2); !bytes.Equal(msg, chunkFrame("t1", 2, nil)) {
+		t.Fatalf("guest-2 got %s, want chunk 2", msg)
+	}
+	if len(g2.send) != 0 {
+		t.Fatal("chunk past guest-2's credit was forwarded")
+	}
+	for seq := uint32(2); seq < 4; seq++ {
+		if msg := nextQueued(t, g1); !bytes.Equal(msg, chunkFrame("t1", seq, nil)) {
+			t.Fatalf("guest-1 got %s, want chunk %d", msg, seq)
+		}
+	}
+
+	// The sender may run at most two windows ahead of the slowest recipient,
+	// which bounds what the relay holds for it.
+	send(g1, transferMsg("transfer:ack", "t1", 4))
+	expectCredit(t, host, 5)
+	send(g2, transferMsg("transfer:ack", "t1", 2))
+	if msg := nextQueued(t, g2); !bytes.Equal(msg, chunkFrame("t1", 3, nil)) {
+		t.Fatalf("guest-2 got %s, want the held chunk 3", msg)
+	}
+	expectCredit(t, host, 6)
+
+	// transfer:end reaches a paused recipient after its held chunks.
+	send(host, chunkFrame("t1", 4, nil))
+	send(host, transferMsg("transfer:end", "t1", 0))
+	nextQueued(t, g1)
+	if msg := nextQueued(t, g1); !bytes.Contains(msg, []byte("transfer:end")) {
+		t.Errorf("guest-1 got %s, want transfer:end", msg)
+	}
+	if len(g2.send) != 0 {
+		t.Fatal("paused recipient got frames past its credit")
+	}
+	key := transferKey(host.connID, "t1")
+	if hub.rooms["room-1"].transfers[key] == nil {
+		t.Fatal("transfer forgotten with frames still held")
+	}
+	send(g2, transferMsg("transfer:ack", "t1", 3))
+	if msg := nextQueued(t, g2); !bytes.Equal(msg, chunkFrame("t1", 4, nil)) {
+		t.Fatalf("guest-2 got %s, want the held chunk 4", msg)
+	}
+	if msg := nextQueued(t, g2); !bytes.Contains(msg, []byte("transfer:end")) {
+		t.Errorf("guest-2 got %s, want transfer:end", msg)
+	}
+	if len(host.send) != 0 {
+		t.Error("credit granted after transfer:end")
+	}
+	if hub.rooms["room-1"].transfers[key] != nil {
+		t.Error("transfer still in flight after its last frame")
+	}
+}
+
+func TestHub_TransferRecipients(t *testing.T) {
+	hub, host, g1, g2 := newTransferRoom(t)
+	send := func(from *Client, data []byte) {
+		hub.broadcast(&BroadcastMsg{RoomID: "room-1", SenderID: from.connID, Data: data})
+	}
+
+	// Recipients are matched on their token peer ID; unknown ones are
+	// reported as for a directed message.
+	g2.setPeerID("guest-1")
+	send(host, []byte(`{"type":"transfer:begin","from":"host","to":["guest-1","ghost"],"payload":{"id":"t1"}}`))
+	if msg := nextQueued(t, host); !bytes.Contains(msg, []byte(`"code":"unknown_recipient"`)) || !bytes.Contains(msg, []byte(`"ghost"`)) {
+		t.Fatalf("got %s, want unknown_recipient naming ghost", msg)
+	}
+	expectCredit(t, host, 2)
+	nextQueued(t, g1)
+	if len(g2.send) != 0 {
+		t.Fatal("transfer reached a peer claiming another's peer ID")
+	}
+
+	// A "to" naming nobody in the room starts nothing.
+	send(host, []byte(`{"type":"transfer:begin","from":"host","to":"ghost","payload":{"id":"t2"}}`))
+	if msg := nextQueued(t, host); !bytes.Contains(msg, []byte("unknown_recipient")) {
+		t.Fatalf("got %s, want unknown_recipient", msg)
+	}
+	if len(host.send) != 0 || hub.rooms["room-1"].transfers[transferKey(host.connID, "t2")] != nil {
+		t.Fatal("transfer to nobody was started")
+	}
+
+	// IDs are scoped to their sender: another peer may use t1 as well, and
+	// cannot end the host's.
+	send(g2, []byte(`{"type":"transfer:begin","from":"guest-2","to":"guest-1","payload":{"id":"t1"}}`))
+	expectCredit(t, g2, 2)
+	nextQueued(t, g1)
+	send(g2, transferMsg("transfer:end", "t1", 0))
+	nextQueued(t, g1)
+	if hub.rooms["room-1"].transfers[transferKey(host.connID, "t1")] == nil {
+		t.Fatal("another peer ended the host's transfer")
+	}
+
+	// With two transfers named t1, an ack names its sender.
+	send(g2, []byte(`{"type":"transfer:begin","from":"guest-2","to":"guest-1","payload":{"id":"t1"}}`))
+	expectCredit(t, g2, 2)
+	nextQueued(t, g1)
+	send(host, chunkFrame("t1", 0, nil))
+	nextQueued(t, g1)
+	send(g1, []byte(`{"type":"transfer:ack","from":"guest-1","to":"host","payload":{"id":"t1","received":1}}`))
+	expectCredit(t, host, 3)
+	if len(g2.send) != 0 {
+		t.Error("ack addressed to the host credited guest-2")
+	}
+}
+
+func TestHub_TransferAborts(t *testing.T) {
+	hub, host, g1, g2 := newTransferRoom(t)
+	send := func(from *Client, data []byte) {
+		hub.broadcast(&BroadcastMsg{RoomID: "room-1", SenderID: from.connID, Data: data})
+	}
+
+	cases := []struct {
+		name   string
+		chunks []uint32
+		reason string
+	}{
+		{"out of order", []uint32{1}, "out_of_order"},
+		{"past credit", []uint32{0, 1, 2}, "no_credit"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := metrics.TransferOutcomes.Value(tc.reason)
+			send(host, transferMsg("transfer:begin", "t1", 0))
+			for _, seq := range tc.chunks {
+				send(host, chunkFrame("t1", seq, nil))
+			}
+			for _, c := range []*Client{host, g1, g2} {
+				var last []byte
+				for len(c.send) > 0 {
+					last = <-c.send
+				}
+				if !bytes.Contains(last, []byte(`"reason":"`+tc.reason+`"`)) {
+					t.Errorf("%s last got %s, want transfer:abort with %s", c.peerID, last, tc.reason)
+				}
+			}
+			if got := metrics.TransferOutcomes.Value(tc.reason) - before; got != 1 {
+				t.Errorf("relay_transfers_total{outcome=%q} = %d, want 1", tc.reason, got)
+			}
+		})
+	}
+
+	// A guest cannot end or feed someone else's transfer.
+	send(host, transferMsg("transfer:begin", "t2", 0))
+	for _, c := range []*Client{host, g1, g2} {
+		for len(c.send) > 0 {
+			<-c.send
+		}
+	}
+	send(g1, chunkFrame("t2", 0, nil))
+	if msg := nextQueued(t, g1); !strings.Contains(string(msg), "unknown_transfer") {
+		t.Errorf("got %s, want unknown_transfer", msg)
+	}
+
+	// The sender leaving aborts its transfers.
+	hub.dropClient(host)
+	if msg := nextQueued(t, g2); !bytes.Contains(msg, []byte(`"reason":"sender_left"`)) {
+		t.Errorf("got %s, want transfer:abort with sender_left", msg)
+	}
+}
+
+func TestHandleWS_Transfer(t *testing.T) {
+	tr := newTestRelay(t, testConfig())
+	host, priv := joinAsHost(t, tr, "room-1")
+	recvOnly := capabilityToken(priv, "room-1", "guest-1", func(c *Claims) { c.RecvOnly = true })
+	guest := tr.dial(t, url.Values{"room": {"room-1"}, "token": {recvOnly}})
+	readEnvelope(t, host, "session:join")
+
+	_ = host.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"transfer:begin","from":"host","to":"guest-1","payload":{"id":"t1","size":65536}}`))
+	readEnvelope(t, guest, "transfer:begin")
+	readEnvelope(t, host, "transfer:credit")
+
+	// The chunk arrives as a frame of its own, byte for byte.
+	chunk := chunkFrame("t1", 0, bytes.Repeat([]byte{'\n'}, 64<<10))
+	_ = host.WriteMessage(websocket.BinaryMessage, chunk)
+	_ = guest.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, got, err := guest.ReadMessage(); err != nil || !bytes.Equal(got, chunk) {
+		t.Fatalf("guest got %d bytes (err %v), want the %d-byte chunk", len(got), err, len(chunk))
+	}
+
+	// A receive-only peer may still acknowledge what it received.
+	_ = guest.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"transfer:ack","from":"guest-1","payload":{"id":"t1","received":1}}`))
+	credit := readEnvelope(t, host, "transfer:credit")
+	if limit := credit["payload"].(map[string]any)["limit"]; limit != float64(17) {
+		t.Errorf("credit limit after ack = %v, want 17", limit)
+	}
+}
+
+func TestHub_TransferRemotePeer(t *testing.T) {
+	hub, host, g1, _ := newTransferRoom(t)
+	hub.remote["room-1"] = map[string]*remotePeer{
+		"conn-r1": {node: "node-b", info: PeerInfo{PeerID: "remote-1"}},
+	}
+	send := func(data []byte) {
+		hub.broadcast(&BroadcastMsg{RoomID: "room-1", SenderID: host.connID, Data: data})
+	}
+
+	// Chunks do not cross the backplane: a transfer to the whole room, or to
+	// a remote peer, is refused rather than silently missing someone.
+	for _, begin := range []string{
+		`{"type":"transfer:begin","from":"host","payload":{"id":"t1"}}`,
+		`{"type":"transfer:begin","from":"host","to":"remote-1","payload":{"id":"t1"}}`,
+	} {
+		send([]byte(begin))
+		if msg := nextQueued(t, host); !bytes.Contains(msg, []byte("transfer_remote_peer")) {
+			t.Errorf("got %s, want transfer_remote_peer", msg)
+		}
+	}
+	if len(g1.send) != 0 || len(hub.rooms["room-1"].transfers) != 0 {
+		t.Fatal("refused transfer was started")
+	}
+
+	// A transfer between local peers still runs.
+	send([]byte(`{"type":"transfer:begin","from":"host","to":"guest-1","payload":{"id":"t1"}}`))
+	expectCredit(t, host, 2)
+}